@@ -4,12 +4,15 @@ import (
 	"context"
 	"io"
 	"net"
+	"net/url"
 	"os"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
 	"github.com/sagernet/sing/common/pipe"
 )
 
@@ -18,6 +21,7 @@ type BidirectionalConn struct {
 	stream           BidirectionalStream
 	logger           logger.ContextLogger
 	cancelled        atomic.Bool
+	writeClosed      atomic.Bool
 	readWaitHeaders  bool
 	writeWaitHeaders bool
 	access           sync.Mutex
@@ -29,6 +33,8 @@ type BidirectionalConn struct {
 	read             chan int
 	write            chan struct{}
 	headers          map[string]string
+	trailers         map[string]string
+	protocol         string
 	readSemaphore    chan struct{}
 	writeSemaphore   chan struct{}
 	readDone         chan struct{}
@@ -39,6 +45,12 @@ type BidirectionalConn struct {
 	onTerminate      func()
 	readDeadline     pipe.Deadline
 	writeDeadline    pipe.Deadline
+	remoteAddr       net.Addr
+	socketAddrs      func() (net.Addr, net.Addr, bool)
+	onReady          func()
+	batch            *writeBatch
+	delayHeaders     bool
+	headersSent      atomic.Bool
 }
 
 func (e StreamEngine) CreateConn(ctx context.Context, l logger.ContextLogger, readWaitHeaders bool, writeWaitHeaders bool) *BidirectionalConn {
@@ -87,6 +99,9 @@ func (c *BidirectionalConn) waitReady(waitHeaders bool, deadline <-chan struct{}
 
 func (c *BidirectionalConn) Start(method string, url string, headers map[string]string, priority int, endOfStream bool) error {
 	c.access.Lock()
+	if c.remoteAddr == nil {
+		c.remoteAddr = remoteAddrFromURL(url)
+	}
 	if !c.stream.Start(method, url, headers, priority, endOfStream) {
 		c.access.Unlock()
 		c.terminate(os.ErrInvalid)
@@ -97,6 +112,7 @@ func (c *BidirectionalConn) Start(method string, url string, headers map[string]
 }
 
 func (c *BidirectionalConn) markTerminatedLocked(err error) (onTerminate func(), marked bool) {
+	c.stopFlushTimerLocked()
 	c.readDoneOnce.Do(func() { close(c.readDone) })
 	c.writeDoneOnce.Do(func() { close(c.writeDone) })
 	c.cancelled.Store(true)
@@ -137,6 +153,9 @@ func (c *BidirectionalConn) Read(p []byte) (n int, err error) {
 	}
 	defer func() { c.readSemaphore <- struct{}{} }()
 
+	if err := c.sendDelayedHeaders(c.readDeadline.Wait()); err != nil {
+		return 0, err
+	}
 	if err := c.waitReady(c.readWaitHeaders, c.readDeadline.Wait()); err != nil {
 		return 0, err
 	}
@@ -177,11 +196,62 @@ func (c *BidirectionalConn) Read(p []byte) (n int, err error) {
 	}
 }
 
+// Write sends p on the stream and waits until Cronet is done with it. With
+// DisableAutoFlush, it returns once p is queued instead, see there.
 func (c *BidirectionalConn) Write(p []byte) (n int, err error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
+	return c.writeStream(p, false)
+}
 
+// CloseWrite sends an empty DATA frame with END_STREAM set. Reads stay open
+// until the remote side finishes the stream, and later writes fail with
+// net.ErrClosed.
+func (c *BidirectionalConn) CloseWrite() error {
+	if !c.writeClosed.CompareAndSwap(false, true) {
+		return nil
+	}
+	_, err := c.writeStream(nil, true)
+	return err
+}
+
+// DelayRequestHeadersUntilFlush holds the request headers back until the
+// first write, so they are sent in one packet with the first data. Reading
+// or waiting for the response headers sends them alone. It is only
+// respected on QUIC and must be called before Start.
+func (c *BidirectionalConn) DelayRequestHeadersUntilFlush() {
+	c.delayHeaders = true
+	c.stream.DelayRequestHeadersUntilFlush(true)
+}
+
+// sendDelayedHeaders sends request headers held back by
+// DelayRequestHeadersUntilFlush if no write has sent them yet, as the
+// response can not arrive before.
+func (c *BidirectionalConn) sendDelayedHeaders(deadline <-chan struct{}) error {
+	if !c.delayHeaders || c.headersSent.Load() {
+		return nil
+	}
+	err := c.waitReady(false, deadline)
+	if err != nil {
+		return err
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	select {
+	case <-c.close:
+		return net.ErrClosed
+	case <-c.done:
+		return c.err
+	default:
+	}
+	if !c.headersSent.Swap(true) {
+		c.stream.Flush()
+	}
+	return nil
+}
+
+func (c *BidirectionalConn) writeStream(p []byte, endOfStream bool) (n int, err error) {
 	select {
 	case <-c.close:
 		return 0, net.ErrClosed
@@ -191,9 +261,16 @@ func (c *BidirectionalConn) Write(p []byte) (n int, err error) {
 	}
 	defer func() { c.writeSemaphore <- struct{}{} }()
 
+	if !endOfStream && c.writeClosed.Load() {
+		return 0, net.ErrClosed
+	}
+
 	if err := c.waitReady(c.writeWaitHeaders, c.writeDeadline.Wait()); err != nil {
 		return 0, err
 	}
+	if c.batch != nil {
+		return c.writeBatched(p, endOfStream)
+	}
 
 	c.access.Lock()
 	select {
@@ -205,7 +282,8 @@ func (c *BidirectionalConn) Write(p []byte) (n int, err error) {
 		return 0, c.err
 	default:
 	}
-	c.stream.Write(p, false)
+	c.stream.Write(p, endOfStream)
+	c.headersSent.Store(true)
 	c.access.Unlock()
 
 	select {
@@ -266,6 +344,7 @@ func (c *BidirectionalConn) Close() error {
 	}
 
 	close(c.close)
+	c.stopFlushTimerLocked()
 	c.access.Unlock()
 
 	if c.cancelled.CompareAndSwap(false, true) {
@@ -274,12 +353,67 @@ func (c *BidirectionalConn) Close() error {
 	return nil
 }
 
+// LocalAddr returns a synthetic unspecified address, as a stream has no local
+// endpoint of its own. See SocketAddrs for the addresses of the socket.
 func (c *BidirectionalConn) LocalAddr() net.Addr {
-	return nil
+	return &net.TCPAddr{IP: net.IPv4zero}
 }
 
+// RemoteAddr returns the tunnel destination for naive connections, and the
+// host of the request URL otherwise. It is nil before Start.
 func (c *BidirectionalConn) RemoteAddr() net.Addr {
-	return nil
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.remoteAddr
+}
+
+// SocketAddrs returns the local and remote addresses of the socket carrying
+// the stream. Cronet does not expose which pooled socket a stream uses, so
+// loaded is false unless the socket is known to be tied to this stream, as
+// for a NaiveClient stream that opened a socket of its own. A stream reusing
+// an existing socket reports loaded false.
+func (c *BidirectionalConn) SocketAddrs() (local net.Addr, remote net.Addr, loaded bool) {
+	if c.socketAddrs == nil {
+		return nil, nil, false
+	}
+	return c.socketAddrs()
+}
+
+// setRemoteAddr overrides the address reported by RemoteAddr. It must be
+// called before Start.
+func (c *BidirectionalConn) setRemoteAddr(destination M.Socksaddr) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	c.remoteAddr = socksaddrToNetAddr(destination, N.NetworkTCP)
+}
+
+func remoteAddrFromURL(rawURL string) net.Addr {
+	requestURL, err := url.Parse(rawURL)
+	if err != nil || requestURL.Hostname() == "" {
+		return nil
+	}
+	port := requestURL.Port()
+	if port == "" {
+		switch requestURL.Scheme {
+		case "http", "ws":
+			port = "80"
+		default:
+			port = "443"
+		}
+	}
+	return socksaddrToNetAddr(M.ParseSocksaddrHostPortStr(requestURL.Hostname(), port), N.NetworkTCP)
+}
+
+// socksaddrToNetAddr returns a *net.TCPAddr or *net.UDPAddr for IP addresses,
+// which most consumers expect, and the Socksaddr itself for domains.
+func socksaddrToNetAddr(destination M.Socksaddr, network string) net.Addr {
+	if !destination.IsIP() {
+		return destination
+	}
+	if network == N.NetworkUDP {
+		return destination.UDPAddr()
+	}
+	return destination.TCPAddr()
 }
 
 func (c *BidirectionalConn) SetDeadline(t time.Time) error {
@@ -299,6 +433,9 @@ func (c *BidirectionalConn) SetWriteDeadline(t time.Time) error {
 }
 
 func (c *BidirectionalConn) WaitForHeaders() (map[string]string, error) {
+	if err := c.sendDelayedHeaders(nil); err != nil {
+		return nil, err
+	}
 	select {
 	case <-c.handshake:
 		return c.headers, nil
@@ -309,7 +446,29 @@ func (c *BidirectionalConn) WaitForHeaders() (map[string]string, error) {
 	}
 }
 
+// Trailers returns the response trailers sent by the server, if any.
+// Trailers are only complete once Read has returned io.EOF.
+func (c *BidirectionalConn) Trailers() map[string]string {
+	c.access.Lock()
+	defer c.access.Unlock()
+	return c.trailers
+}
+
+// NegotiatedProtocol returns the protocol negotiated for the stream, such as
+// "h2" or "h3". It is empty until the response headers have been received.
+func (c *BidirectionalConn) NegotiatedProtocol() string {
+	select {
+	case <-c.handshake:
+		return c.protocol
+	default:
+		return ""
+	}
+}
+
 func (c *BidirectionalConn) WaitForHeadersContext(ctx context.Context) (map[string]string, error) {
+	if err := c.sendDelayedHeaders(ctx.Done()); err != nil {
+		return nil, err
+	}
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
@@ -329,11 +488,17 @@ type bidirectionalHandler struct {
 }
 
 func (c *bidirectionalHandler) OnStreamReady(stream BidirectionalStream) {
-	c.readyOnce.Do(func() { close(c.ready) })
+	c.readyOnce.Do(func() {
+		if c.onReady != nil {
+			c.onReady()
+		}
+		close(c.ready)
+	})
 }
 
 func (c *bidirectionalHandler) OnResponseHeadersReceived(stream BidirectionalStream, headers map[string]string, negotiatedProtocol string) {
 	c.headers = headers
+	c.protocol = negotiatedProtocol
 	c.logger.DebugContext(c.ctx, "response received, protocol: ", negotiatedProtocol, ", status: ", headers[":status"])
 	c.handshakeOnce.Do(func() { close(c.handshake) })
 }
@@ -354,6 +519,10 @@ func (c *bidirectionalHandler) OnReadCompleted(stream BidirectionalStream, bytes
 }
 
 func (c *bidirectionalHandler) OnWriteCompleted(stream BidirectionalStream) {
+	if c.batch != nil {
+		c.onBatchWriteCompleted()
+		return
+	}
 	select {
 	case <-c.close:
 		c.writeDoneOnce.Do(func() { close(c.writeDone) })
@@ -364,6 +533,9 @@ func (c *bidirectionalHandler) OnWriteCompleted(stream BidirectionalStream) {
 }
 
 func (c *bidirectionalHandler) OnResponseTrailersReceived(stream BidirectionalStream, trailers map[string]string) {
+	c.access.Lock()
+	c.trailers = trailers
+	c.access.Unlock()
 }
 
 func (c *bidirectionalHandler) OnSucceeded(stream BidirectionalStream) {
@@ -0,0 +1,180 @@
+package cronet
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/sagernet/sing/common/buf"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var _ N.VectorisedWriter = (*BidirectionalConn)(nil)
+
+// WriteBatchOptions configures write batching. See
+// BidirectionalConn.DisableAutoFlush.
+type WriteBatchOptions struct {
+	// FlushSize flushes queued writes once this many bytes are queued.
+	// Defaults to 16 KiB.
+	FlushSize int
+	// FlushDelay flushes queued writes this long after the first one.
+	// Defaults to 1ms.
+	FlushDelay time.Duration
+}
+
+const (
+	defaultWriteBatchFlushSize  = 16 * 1024
+	defaultWriteBatchFlushDelay = time.Millisecond
+	// writeBatchInFlightFactor bounds the bytes queued on the stream and not
+	// yet sent to this many times FlushSize.
+	writeBatchInFlightFactor = 4
+)
+
+type writeBatch struct {
+	options         WriteBatchOptions
+	pending         [][]byte
+	inFlight        int
+	unflushedWrites int
+	unflushedBytes  int
+	timer           *time.Timer
+	completed       chan struct{}
+}
+
+// DisableAutoFlush enables write batching. Write copies the data, queues it
+// on the stream and returns without waiting for it to be sent. Queued data is
+// sent once FlushSize bytes are queued, FlushDelay after the first queued
+// write, or on Flush. It must be called before Start.
+//
+// As Write returns before its data is sent, a failure to send it is not
+// returned by that Write, but by a later Read, Write or Flush, once the
+// stream has failed.
+func (c *BidirectionalConn) DisableAutoFlush(options WriteBatchOptions) {
+	if options.FlushSize <= 0 {
+		options.FlushSize = defaultWriteBatchFlushSize
+	}
+	if options.FlushDelay <= 0 {
+		options.FlushDelay = defaultWriteBatchFlushDelay
+	}
+	c.batch = &writeBatch{
+		options:   options,
+		completed: make(chan struct{}, 1),
+	}
+	c.stream.DisableAutoFlush(true)
+}
+
+// Flush sends the writes queued since the last flush. It does nothing unless
+// DisableAutoFlush was called.
+func (c *BidirectionalConn) Flush() error {
+	if c.batch == nil {
+		return nil
+	}
+	c.access.Lock()
+	defer c.access.Unlock()
+	select {
+	case <-c.close:
+		return net.ErrClosed
+	case <-c.done:
+		return c.err
+	default:
+	}
+	c.flushLocked()
+	return nil
+}
+
+func (c *BidirectionalConn) flushLocked() {
+	c.stopFlushTimerLocked()
+	if c.batch.unflushedWrites == 0 {
+		return
+	}
+	c.batch.unflushedWrites = 0
+	c.batch.unflushedBytes = 0
+	c.stream.Flush()
+	c.headersSent.Store(true)
+}
+
+func (c *BidirectionalConn) stopFlushTimerLocked() {
+	if c.batch != nil && c.batch.timer != nil {
+		c.batch.timer.Stop()
+		c.batch.timer = nil
+	}
+}
+
+// writeBatched queues p on the stream. The caller holds the write semaphore
+// and the stream is ready.
+func (c *BidirectionalConn) writeBatched(p []byte, endOfStream bool) (n int, err error) {
+	maxInFlight := c.batch.options.FlushSize * writeBatchInFlightFactor
+	for {
+		c.access.Lock()
+		select {
+		case <-c.close:
+			c.access.Unlock()
+			return 0, net.ErrClosed
+		case <-c.done:
+			c.access.Unlock()
+			return 0, c.err
+		default:
+		}
+		if c.batch.inFlight == 0 || c.batch.inFlight+len(p) <= maxInFlight {
+			break
+		}
+		// Flush so the queued writes complete and make room.
+		c.flushLocked()
+		c.access.Unlock()
+		select {
+		case <-c.batch.completed:
+		case <-c.writeDeadline.Wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-c.done:
+			return 0, c.err
+		case <-c.close:
+			return 0, net.ErrClosed
+		}
+	}
+	var data []byte
+	if len(p) > 0 {
+		data = append([]byte(nil), p...)
+	}
+	// Cronet reads data until OnWriteCompleted, so it is kept referenced in
+	// pending until then.
+	c.batch.pending = append(c.batch.pending, data)
+	c.batch.inFlight += len(data)
+	c.batch.unflushedWrites++
+	c.batch.unflushedBytes += len(data)
+	c.stream.Write(data, endOfStream)
+	if endOfStream || c.batch.unflushedBytes >= c.batch.options.FlushSize {
+		c.flushLocked()
+	} else if c.batch.timer == nil {
+		c.batch.timer = time.AfterFunc(c.batch.options.FlushDelay, func() {
+			c.Flush()
+		})
+	}
+	c.access.Unlock()
+	return len(p), nil
+}
+
+func (c *BidirectionalConn) onBatchWriteCompleted() {
+	c.access.Lock()
+	if len(c.batch.pending) > 0 {
+		c.batch.inFlight -= len(c.batch.pending[0])
+		c.batch.pending[0] = nil
+		c.batch.pending = c.batch.pending[1:]
+	}
+	c.access.Unlock()
+	select {
+	case c.batch.completed <- struct{}{}:
+	default:
+	}
+}
+
+// WriteVectorised writes buffers one after another. With DisableAutoFlush,
+// they are sent together.
+func (c *BidirectionalConn) WriteVectorised(buffers []*buf.Buffer) error {
+	defer buf.ReleaseMulti(buffers)
+	for _, buffer := range buffers {
+		_, err := c.Write(buffer.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
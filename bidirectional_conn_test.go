@@ -0,0 +1,40 @@
+package cronet
+
+import (
+	"net"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+func TestRemoteAddrFromURL(t *testing.T) {
+	t.Parallel()
+	for rawURL, expected := range map[string]string{
+		"https://example.org/path":   "example.org:443",
+		"https://example.org:8443/":  "example.org:8443",
+		"http://127.0.0.1/":          "127.0.0.1:80",
+		"https://[::1]:10443/masque": "[::1]:10443",
+	} {
+		addr := remoteAddrFromURL(rawURL)
+		if addr == nil || addr.String() != expected {
+			t.Fatalf("%s: expected %s, got %v", rawURL, expected, addr)
+		}
+	}
+	if addr := remoteAddrFromURL("://invalid"); addr != nil {
+		t.Fatalf("expected nil address, got %v", addr)
+	}
+}
+
+func TestSocksaddrToNetAddr(t *testing.T) {
+	t.Parallel()
+	if _, isTCP := socksaddrToNetAddr(M.ParseSocksaddr("1.1.1.1:443"), N.NetworkTCP).(*net.TCPAddr); !isTCP {
+		t.Fatal("expected *net.TCPAddr for IP destination")
+	}
+	if _, isUDP := socksaddrToNetAddr(M.ParseSocksaddr("1.1.1.1:53"), N.NetworkUDP).(*net.UDPAddr); !isUDP {
+		t.Fatal("expected *net.UDPAddr for UDP destination")
+	}
+	if addr := socksaddrToNetAddr(M.ParseSocksaddr("example.org:443"), N.NetworkTCP); addr.String() != "example.org:443" {
+		t.Fatalf("unexpected domain address %s", addr)
+	}
+}
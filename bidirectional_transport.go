@@ -0,0 +1,188 @@
+package cronet
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+)
+
+// BidirectionalRoundTripper is a full-duplex http.RoundTripper built on BidirectionalConn.
+//
+// Unlike RoundTripper, the request body is streamed while the response is being read,
+// and response trailers are reported in http.Response.Trailer once the body has been
+// read to io.EOF. This makes it suitable for gRPC and other bidi-streaming APIs.
+//
+// Bidirectional streams are only supported over HTTP/2 and HTTP/3. Header values are
+// delivered by Cronet as a single value per name.
+type BidirectionalRoundTripper struct {
+	// Engine must be started before the first RoundTrip and outlive all responses.
+	Engine Engine
+	Logger logger.ContextLogger
+}
+
+func (t *BidirectionalRoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	var emptyEngine Engine
+	if t.Engine == emptyEngine {
+		closeRequestBody(request)
+		return nil, E.New("missing engine")
+	}
+	l := t.Logger
+	if l == nil {
+		l = logger.NOP()
+	}
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	headers := make(map[string]string, len(request.Header))
+	for key, values := range request.Header {
+		if len(values) == 0 {
+			continue
+		}
+		separator := ", "
+		if http.CanonicalHeaderKey(key) == "Cookie" {
+			separator = "; "
+		}
+		headers[key] = strings.Join(values, separator)
+	}
+	hasBody := request.Body != nil && request.Body != http.NoBody
+
+	ctx := request.Context()
+	conn := t.Engine.StreamEngine().CreateConn(ctx, l, true, false)
+	err := conn.Start(method, request.URL.String(), headers, 0, !hasBody)
+	if err != nil {
+		closeRequestBody(request)
+		return nil, err
+	}
+	if hasBody {
+		go uploadRequestBody(conn, request.Body)
+	}
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-conn.Done():
+			}
+		}()
+	}
+
+	responseHeaders, err := conn.WaitForHeadersContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	statusCode, err := strconv.Atoi(responseHeaders[":status"])
+	if err != nil {
+		conn.Close()
+		return nil, E.New("invalid response status: ", responseHeaders[":status"])
+	}
+	proto, protoMajor, protoMinor := httpProtoFromNegotiated(conn.NegotiatedProtocol())
+	response := &http.Response{
+		Status:        strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode:    statusCode,
+		Proto:         proto,
+		ProtoMajor:    protoMajor,
+		ProtoMinor:    protoMinor,
+		Header:        make(http.Header, len(responseHeaders)),
+		ContentLength: -1,
+		Request:       request,
+	}
+	for key, value := range responseHeaders {
+		if strings.HasPrefix(key, ":") {
+			continue
+		}
+		response.Header.Add(key, value)
+	}
+	if contentLength, parseErr := strconv.ParseInt(response.Header.Get("Content-Length"), 10, 64); parseErr == nil && contentLength >= 0 {
+		response.ContentLength = contentLength
+	}
+	for _, value := range response.Header.Values("Trailer") {
+		for _, key := range strings.Split(value, ",") {
+			key = http.CanonicalHeaderKey(strings.TrimSpace(key))
+			if key == "" {
+				continue
+			}
+			if response.Trailer == nil {
+				response.Trailer = make(http.Header)
+			}
+			response.Trailer[key] = nil
+		}
+	}
+	response.Header.Del("Trailer")
+	response.Body = &bidirectionalResponseBody{conn: conn, response: response}
+	return response, nil
+}
+
+func uploadRequestBody(conn *BidirectionalConn, body io.ReadCloser) {
+	defer body.Close()
+	_, err := io.Copy(conn, body)
+	if err == nil {
+		err = conn.CloseWrite()
+	}
+	if err != nil {
+		conn.Close()
+	}
+}
+
+func closeRequestBody(request *http.Request) {
+	if request.Body != nil {
+		request.Body.Close()
+	}
+}
+
+type bidirectionalResponseBody struct {
+	conn      *BidirectionalConn
+	response  *http.Response
+	closeOnce sync.Once
+}
+
+func (b *bidirectionalResponseBody) Read(p []byte) (n int, err error) {
+	n, err = b.conn.Read(p)
+	if err == io.EOF {
+		b.fillTrailer()
+	}
+	return
+}
+
+func (b *bidirectionalResponseBody) fillTrailer() {
+	trailers := b.conn.Trailers()
+	if len(trailers) == 0 {
+		return
+	}
+	if b.response.Trailer == nil {
+		b.response.Trailer = make(http.Header, len(trailers))
+	}
+	for key, value := range trailers {
+		b.response.Trailer.Set(key, value)
+	}
+}
+
+func (b *bidirectionalResponseBody) Close() error {
+	err := os.ErrClosed
+	b.closeOnce.Do(func() {
+		err = b.conn.Close()
+	})
+	return err
+}
+
+// httpProtoFromNegotiated maps a Cronet negotiated protocol (ALPN) to the
+// http.Response protocol fields.
+func httpProtoFromNegotiated(negotiatedProtocol string) (proto string, major int, minor int) {
+	switch {
+	case negotiatedProtocol == "h2":
+		return "HTTP/2.0", 2, 0
+	case negotiatedProtocol == "h3", strings.HasPrefix(negotiatedProtocol, "h3-"), strings.HasPrefix(negotiatedProtocol, "quic"):
+		return "HTTP/3.0", 3, 0
+	case negotiatedProtocol == "http/1.0":
+		return "HTTP/1.0", 1, 0
+	default:
+		return "HTTP/1.1", 1, 1
+	}
+}
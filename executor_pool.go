@@ -0,0 +1,226 @@
+package cronet
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+)
+
+// ExecutorOptions configures the executors created by NewWorkerPoolExecutor,
+// NewSerialExecutor and NewDirectExecutor.
+type ExecutorOptions struct {
+	Logger logger.ContextLogger
+	// PanicHandler is called with the recovered value when a Runnable panics.
+	// If nil, the panic is logged with Logger.
+	PanicHandler func(value any)
+}
+
+// ExecutorStats is a snapshot of the work tracked by a ManagedExecutor.
+type ExecutorStats struct {
+	Queued  int64
+	Running int64
+	// Overflow counts Runnables run on a goroutine of their own because the
+	// queue was full.
+	Overflow int64
+}
+
+// executorCommand is the part of Runnable a ManagedExecutor uses.
+type executorCommand interface {
+	Run()
+	Destroy()
+}
+
+// ManagedExecutor is an Executor backed by a fixed set of goroutines.
+//
+// Runnables that panic are recovered and reported instead of crashing the
+// process, and Runnables still queued when the executor is closed are
+// destroyed without being run.
+type ManagedExecutor struct {
+	Executor
+	logger       logger.ContextLogger
+	panicHandler func(value any)
+
+	access    sync.Mutex
+	available *sync.Cond
+	queue     []executorCommand
+	queueSize int
+	closed    bool
+	workers   sync.WaitGroup
+	queued    atomic.Int64
+	running   atomic.Int64
+	overflow  atomic.Int64
+}
+
+// NewWorkerPoolExecutor creates an executor that runs Runnables on workers
+// goroutines. At most queueSize Runnables wait for a free worker; when the
+// queue is full, the Runnable is run on a goroutine of its own, as Execute is
+// called on the Cronet network thread and must neither block nor run the
+// Runnable there. A queueSize of zero or less means the queue is unbounded.
+func NewWorkerPoolExecutor(workers int, queueSize int, options ExecutorOptions) (*ManagedExecutor, error) {
+	if workers <= 0 {
+		return nil, E.New("invalid executor worker count: ", workers)
+	}
+	e := newWorkerPool(workers, queueSize, options)
+	e.Executor = NewExecutor(func(executor Executor, command Runnable) {
+		e.enqueue(command)
+	})
+	return e, nil
+}
+
+// NewSerialExecutor creates an executor that runs Runnables one at a time,
+// in the order they are posted, on a single goroutine.
+func NewSerialExecutor(options ExecutorOptions) *ManagedExecutor {
+	e := newWorkerPool(1, 0, options)
+	e.Executor = NewExecutor(func(executor Executor, command Runnable) {
+		e.enqueue(command)
+	})
+	return e
+}
+
+func newWorkerPool(workers int, queueSize int, options ExecutorOptions) *ManagedExecutor {
+	e := newManagedExecutor(options)
+	e.queueSize = queueSize
+	e.available = sync.NewCond(&e.access)
+	e.workers.Add(workers)
+	for i := 0; i < workers; i++ {
+		go e.loopWorker()
+	}
+	return e
+}
+
+// NewDirectExecutor creates an executor that runs Runnables synchronously on
+// the calling thread, which is usually the Cronet network thread. Runnables
+// must not block.
+func NewDirectExecutor(options ExecutorOptions) *ManagedExecutor {
+	e := newManagedExecutor(options)
+	e.Executor = NewExecutor(func(executor Executor, command Runnable) {
+		e.access.Lock()
+		if e.closed {
+			e.access.Unlock()
+			command.Destroy()
+			return
+		}
+		e.workers.Add(1)
+		e.access.Unlock()
+		e.run(command)
+		e.workers.Done()
+	})
+	return e
+}
+
+func newManagedExecutor(options ExecutorOptions) *ManagedExecutor {
+	l := options.Logger
+	if l == nil {
+		l = logger.NOP()
+	}
+	return &ManagedExecutor{
+		logger:       l,
+		panicHandler: options.PanicHandler,
+	}
+}
+
+func (e *ManagedExecutor) enqueue(command executorCommand) {
+	e.access.Lock()
+	if e.closed {
+		e.access.Unlock()
+		command.Destroy()
+		return
+	}
+	if e.queueSize > 0 && len(e.queue) >= e.queueSize {
+		e.workers.Add(1)
+		e.access.Unlock()
+		e.overflow.Add(1)
+		go func() {
+			defer e.workers.Done()
+			e.run(command)
+		}()
+		return
+	}
+	e.queue = append(e.queue, command)
+	e.queued.Add(1)
+	e.available.Signal()
+	e.access.Unlock()
+}
+
+func (e *ManagedExecutor) loopWorker() {
+	defer e.workers.Done()
+	for {
+		e.access.Lock()
+		for !e.closed && len(e.queue) == 0 {
+			e.available.Wait()
+		}
+		if e.closed {
+			e.access.Unlock()
+			return
+		}
+		command := e.queue[0]
+		e.queue[0] = nil
+		e.queue = e.queue[1:]
+		e.queued.Add(-1)
+		e.access.Unlock()
+		e.run(command)
+	}
+}
+
+func (e *ManagedExecutor) run(command executorCommand) {
+	e.running.Add(1)
+	defer func() {
+		command.Destroy()
+		e.running.Add(-1)
+		if value := recover(); value != nil {
+			if e.panicHandler != nil {
+				e.panicHandler(value)
+			} else {
+				e.logger.Error("executor runnable panic: ", value)
+			}
+		}
+	}()
+	command.Run()
+}
+
+// Stats returns the number of queued and running Runnables, and how many
+// Runnables overflowed the queue so far.
+func (e *ManagedExecutor) Stats() ExecutorStats {
+	return ExecutorStats{
+		Queued:   e.queued.Load(),
+		Running:  e.running.Load(),
+		Overflow: e.overflow.Load(),
+	}
+}
+
+// Close stops accepting Runnables, destroys the ones still queued, waits for
+// running ones to return and destroys the Executor. Close must not be called
+// from a Runnable of the same executor.
+func (e *ManagedExecutor) Close() error {
+	err := e.shutdown()
+	if err != nil {
+		return err
+	}
+	e.Executor.Destroy()
+	return nil
+}
+
+func (e *ManagedExecutor) shutdown() error {
+	e.access.Lock()
+	if e.closed {
+		e.access.Unlock()
+		return net.ErrClosed
+	}
+	e.closed = true
+	pending := e.queue
+	e.queue = nil
+	e.queued.Add(-int64(len(pending)))
+	if e.available != nil {
+		e.available.Broadcast()
+	}
+	e.access.Unlock()
+
+	for _, command := range pending {
+		command.Destroy()
+	}
+	e.workers.Wait()
+	return nil
+}
@@ -0,0 +1,161 @@
+package cronet
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testExecutorCommand struct {
+	run       func()
+	ran       atomic.Bool
+	destroyed atomic.Bool
+}
+
+func (c *testExecutorCommand) Run() {
+	c.ran.Store(true)
+	if c.run != nil {
+		c.run()
+	}
+}
+
+func (c *testExecutorCommand) Destroy() {
+	c.destroyed.Store(true)
+}
+
+func waitExecutorCondition(t *testing.T, condition func() bool, message string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestWorkerPoolExecutorInvalidWorkers(t *testing.T) {
+	_, err := NewWorkerPoolExecutor(0, 0, ExecutorOptions{})
+	if err == nil {
+		t.Fatal("expected an error for zero workers")
+	}
+}
+
+func TestWorkerPoolExecutorFullQueue(t *testing.T) {
+	e := newWorkerPool(1, 1, ExecutorOptions{})
+	release := make(chan struct{})
+	blocking := &testExecutorCommand{run: func() { <-release }}
+	e.enqueue(blocking)
+	waitExecutorCondition(t, func() bool { return e.Stats().Running == 1 }, "worker did not start the first runnable")
+
+	queued := &testExecutorCommand{}
+	e.enqueue(queued)
+	overflowDone := make(chan struct{})
+	overflow := &testExecutorCommand{run: func() { close(overflowDone) }}
+	enqueued := make(chan struct{})
+	go func() {
+		e.enqueue(overflow)
+		close(enqueued)
+	}()
+	select {
+	case <-enqueued:
+	case <-time.After(5 * time.Second):
+		t.Fatal("enqueue blocked on a full queue")
+	}
+	select {
+	case <-overflowDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("overflowed runnable did not run while the worker was busy")
+	}
+	if stats := e.Stats(); stats.Queued != 1 || stats.Overflow != 1 {
+		t.Fatalf("unexpected stats with a full queue: %+v", stats)
+	}
+
+	close(release)
+	waitExecutorCondition(t, queued.destroyed.Load, "queued runnable was not run")
+	if err := e.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+	if !queued.ran.Load() || !overflow.destroyed.Load() {
+		t.Error("runnables were not run and destroyed")
+	}
+	if stats := e.Stats(); stats.Queued != 0 || stats.Running != 0 {
+		t.Errorf("unexpected stats after shutdown: %+v", stats)
+	}
+}
+
+func TestWorkerPoolExecutorPanicHandler(t *testing.T) {
+	recovered := make(chan any, 1)
+	e := newWorkerPool(1, 0, ExecutorOptions{
+		PanicHandler: func(value any) {
+			recovered <- value
+		},
+	})
+	command := &testExecutorCommand{run: func() { panic("runnable panic") }}
+	e.enqueue(command)
+	select {
+	case value := <-recovered:
+		if value != "runnable panic" {
+			t.Errorf("unexpected recovered value: %v", value)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("panic was not reported to the PanicHandler")
+	}
+	if !command.destroyed.Load() {
+		t.Error("panicking runnable was not destroyed")
+	}
+
+	// The worker survives the panic.
+	next := &testExecutorCommand{}
+	e.enqueue(next)
+	waitExecutorCondition(t, next.destroyed.Load, "worker stopped after a panic")
+	if err := e.shutdown(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWorkerPoolExecutorDestroyPendingOnClose(t *testing.T) {
+	e := newWorkerPool(1, 0, ExecutorOptions{})
+	release := make(chan struct{})
+	blocking := &testExecutorCommand{run: func() { <-release }}
+	e.enqueue(blocking)
+	waitExecutorCondition(t, func() bool { return e.Stats().Running == 1 }, "worker did not start the first runnable")
+	pending := []*testExecutorCommand{{}, {}}
+	for _, command := range pending {
+		e.enqueue(command)
+	}
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- e.shutdown()
+	}()
+	for _, command := range pending {
+		waitExecutorCondition(t, command.destroyed.Load, "pending runnable was not destroyed on close")
+	}
+	select {
+	case <-closed:
+		t.Fatal("close returned before the running runnable finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-closed; err != nil {
+		t.Fatal(err)
+	}
+	for _, command := range pending {
+		if command.ran.Load() {
+			t.Error("pending runnable was run after close")
+		}
+	}
+	if !blocking.destroyed.Load() {
+		t.Error("running runnable was not destroyed")
+	}
+
+	late := &testExecutorCommand{}
+	e.enqueue(late)
+	if late.ran.Load() || !late.destroyed.Load() {
+		t.Error("runnable posted after close was not destroyed")
+	}
+	if stats := e.Stats(); stats.Queued != 0 || stats.Running != 0 {
+		t.Errorf("unexpected stats after close: %+v", stats)
+	}
+}
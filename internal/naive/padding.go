@@ -0,0 +1,286 @@
+// Package naive implements the framing shared by the naive client and server.
+package naive
+
+import (
+	"encoding/binary"
+	"io"
+	"strings"
+
+	"github.com/sagernet/sing/common"
+	"github.com/sagernet/sing/common/buf"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/rw"
+)
+
+const (
+	PaddingCount        = 8
+	MaxPaddingChunkSize = 65535
+)
+
+// PaddingType is a padding scheme of the naive protocol, negotiated with the
+// Padding-Type-Request and Padding-Type-Reply headers.
+type PaddingType int
+
+const (
+	PaddingTypeNone PaddingType = iota
+	// PaddingTypeVariant1 pads the first PaddingCount frames in each
+	// direction with a 3-byte header and up to 255 zero bytes.
+	PaddingTypeVariant1
+)
+
+// PaddingTypeRequest lists the padding types supported by the client, in
+// order of preference.
+const PaddingTypeRequest = "1, 0"
+
+// PaddingTypeRequestVariant1 only offers variant 1, for clients that pad
+// early data before the reply can be known.
+const PaddingTypeRequestVariant1 = "1"
+
+// ParsePaddingTypeReply returns the padding type chosen by the server.
+// Servers that predate negotiation echo a Padding header when they support
+// variant 1, and servers without padding support send neither header.
+func ParsePaddingTypeReply(headers map[string]string) (PaddingType, error) {
+	if reply, loaded := LookupHeader(headers, "padding-type-reply"); loaded {
+		switch strings.TrimSpace(reply) {
+		case "0":
+			return PaddingTypeNone, nil
+		case "1":
+			return PaddingTypeVariant1, nil
+		default:
+			return PaddingTypeNone, E.New("unsupported padding type reply: ", reply)
+		}
+	}
+	if _, loaded := LookupHeader(headers, "padding"); loaded {
+		return PaddingTypeVariant1, nil
+	}
+	return PaddingTypeNone, nil
+}
+
+// ParsePaddingTypeRequest returns the first supported padding type in a
+// Padding-Type-Request header. Clients that predate negotiation only send a
+// Padding header, which implies variant 1.
+func ParsePaddingTypeRequest(request string, legacyPadding bool) (PaddingType, bool) {
+	if request == "" {
+		if legacyPadding {
+			return PaddingTypeVariant1, true
+		}
+		return PaddingTypeNone, true
+	}
+	for _, element := range strings.Split(request, ",") {
+		switch strings.TrimSpace(element) {
+		case "0":
+			return PaddingTypeNone, true
+		case "1":
+			return PaddingTypeVariant1, true
+		}
+	}
+	return PaddingTypeNone, false
+}
+
+// LookupHeader looks up name in headers case-insensitively.
+func LookupHeader(headers map[string]string, name string) (string, bool) {
+	if value, loaded := headers[name]; loaded {
+		return value, true
+	}
+	for key, value := range headers {
+		if strings.EqualFold(key, name) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+// PaddingConn holds the padding state of one connection. Reads and writes
+// keep separate counters, so one reader and one writer may use it
+// concurrently. The zero value does not pad.
+type PaddingConn struct {
+	policy           *PaddingPolicy
+	frames           int
+	readPadding      int
+	writePadding     int
+	readRemaining    int
+	paddingRemaining int
+}
+
+// NewPaddingConn returns the padding state for a connection using policy,
+// which must be validated. A nil policy uses the default policy.
+func NewPaddingConn(policy *PaddingPolicy) PaddingConn {
+	conn := PaddingConn{policy: policy, frames: PaddingCount}
+	if policy != nil {
+		conn.frames = policy.Frames
+		if len(policy.LaterSizes) > 0 {
+			conn.frames = -1
+		}
+	}
+	return conn
+}
+
+// Disable stops padding, for peers that negotiated no padding. It must be
+// called before the first read or write.
+func (p *PaddingConn) Disable() {
+	p.frames = 0
+}
+
+func (p *PaddingConn) readPadded() bool {
+	return p.frames < 0 || p.readPadding < p.frames
+}
+
+func (p *PaddingConn) writePadded() bool {
+	return p.frames < 0 || p.writePadding < p.frames
+}
+
+func (p *PaddingConn) paddingSize() int {
+	if p.policy == nil {
+		return samplePaddingSize(nil)
+	}
+	if p.writePadding < p.policy.Frames {
+		return samplePaddingSize(p.policy.Sizes)
+	}
+	return samplePaddingSize(p.policy.LaterSizes)
+}
+
+func (p *PaddingConn) Read(reader io.Reader, buffer []byte) (n int, err error) {
+	if p.readRemaining > 0 {
+		if len(buffer) > p.readRemaining {
+			buffer = buffer[:p.readRemaining]
+		}
+		n, err = reader.Read(buffer)
+		if err != nil {
+			return
+		}
+		p.readRemaining -= n
+		return
+	}
+	if p.paddingRemaining > 0 {
+		err = rw.SkipN(reader, p.paddingRemaining)
+		if err != nil {
+			return
+		}
+		p.paddingRemaining = 0
+	}
+	if p.readPadded() {
+		var paddingHeader []byte
+		if len(buffer) >= 3 {
+			paddingHeader = buffer[:3]
+		} else {
+			paddingHeader = make([]byte, 3)
+		}
+		_, err = io.ReadFull(reader, paddingHeader)
+		if err != nil {
+			return
+		}
+		originalDataSize := int(binary.BigEndian.Uint16(paddingHeader[:2]))
+		paddingSize := int(paddingHeader[2])
+		if len(buffer) > originalDataSize {
+			buffer = buffer[:originalDataSize]
+		}
+		n, err = reader.Read(buffer)
+		if err != nil {
+			return
+		}
+		if p.frames >= 0 {
+			p.readPadding++
+		}
+		p.readRemaining = originalDataSize - n
+		p.paddingRemaining = paddingSize
+		return
+	}
+	return reader.Read(buffer)
+}
+
+func (p *PaddingConn) write(writer io.Writer, data []byte) (n int, err error) {
+	if p.writePadded() {
+		paddingSize := p.paddingSize()
+		buffer := buf.NewSize(3 + len(data) + paddingSize)
+		defer buffer.Release()
+		header := buffer.Extend(3)
+		binary.BigEndian.PutUint16(header, uint16(len(data)))
+		header[2] = byte(paddingSize)
+		common.Must1(buffer.Write(data))
+		if paddingSize > 0 {
+			common.Must(buffer.WriteZeroN(paddingSize))
+		}
+		_, err = writer.Write(buffer.Bytes())
+		if err == nil {
+			n = len(data)
+		}
+		if p.frames >= 0 || p.writePadding < p.policy.Frames {
+			p.writePadding++
+		}
+		return
+	}
+	return writer.Write(data)
+}
+
+// WriteBuffer writes buffer as one frame, using FrontHeadroom and
+// RearHeadroom of buffer for the padding.
+func (p *PaddingConn) WriteBuffer(writer io.Writer, buffer *buf.Buffer) error {
+	if p.writePadded() {
+		bufferLen := buffer.Len()
+		if bufferLen > MaxPaddingChunkSize {
+			_, err := p.Write(writer, buffer.Bytes())
+			return err
+		}
+		paddingSize := p.paddingSize()
+		header := buffer.ExtendHeader(3)
+		binary.BigEndian.PutUint16(header, uint16(bufferLen))
+		header[2] = byte(paddingSize)
+		if paddingSize > 0 {
+			common.Must(buffer.WriteZeroN(paddingSize))
+		}
+		if p.frames >= 0 || p.writePadding < p.policy.Frames {
+			p.writePadding++
+		}
+	}
+	return common.Error(writer.Write(buffer.Bytes()))
+}
+
+// Write writes data in frames of at most MaxPaddingChunkSize bytes.
+func (p *PaddingConn) Write(writer io.Writer, data []byte) (n int, err error) {
+	for len(data) > 0 {
+		var chunk []byte
+		if len(data) > MaxPaddingChunkSize {
+			chunk = data[:MaxPaddingChunkSize]
+			data = data[MaxPaddingChunkSize:]
+		} else {
+			chunk = data
+			data = nil
+		}
+		var written int
+		written, err = p.write(writer, chunk)
+		n += written
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (p *PaddingConn) FrontHeadroom() int {
+	if p.writePadded() {
+		return 3
+	}
+	return 0
+}
+
+func (p *PaddingConn) RearHeadroom() int {
+	if p.writePadded() {
+		return maxPaddingSize
+	}
+	return 0
+}
+
+func (p *PaddingConn) WriterMTU() int {
+	if p.writePadded() {
+		return MaxPaddingChunkSize
+	}
+	return 0
+}
+
+func (p *PaddingConn) ReaderReplaceable() bool {
+	return p.readPadding == p.frames
+}
+
+func (p *PaddingConn) WriterReplaceable() bool {
+	return p.writePadding == p.frames
+}
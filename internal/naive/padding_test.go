@@ -0,0 +1,98 @@
+package naive
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParsePaddingTypeReply(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		name     string
+		headers  map[string]string
+		expected PaddingType
+		invalid  bool
+	}{
+		{name: "reply variant1", headers: map[string]string{"padding-type-reply": "1"}, expected: PaddingTypeVariant1},
+		{name: "reply none", headers: map[string]string{"Padding-Type-Reply": " 0 "}, expected: PaddingTypeNone},
+		{name: "reply overrides legacy", headers: map[string]string{"padding-type-reply": "0", "padding": "xxxx"}, expected: PaddingTypeNone},
+		{name: "legacy padding", headers: map[string]string{"padding": "xxxx"}, expected: PaddingTypeVariant1},
+		{name: "no padding", headers: map[string]string{":status": "200"}, expected: PaddingTypeNone},
+		{name: "unknown reply", headers: map[string]string{"padding-type-reply": "2"}, invalid: true},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			paddingType, err := ParsePaddingTypeReply(testCase.headers)
+			if testCase.invalid {
+				if err == nil {
+					t.Fatal("expected error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if paddingType != testCase.expected {
+				t.Fatalf("expected padding type %d, got %d", testCase.expected, paddingType)
+			}
+		})
+	}
+}
+
+func TestPaddingFramesRoundTrip(t *testing.T) {
+	t.Parallel()
+	for _, paddingFrames := range []int{0, PaddingCount} {
+		var (
+			stream bytes.Buffer
+			writer = NewPaddingConn(nil)
+			reader = NewPaddingConn(nil)
+		)
+		if paddingFrames == 0 {
+			writer.Disable()
+			reader.Disable()
+		}
+		messages := [][]byte{[]byte("hello"), bytes.Repeat([]byte{'a'}, 1000), []byte("world")}
+		for _, message := range messages {
+			_, err := writer.Write(&stream, message)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if paddingFrames == 0 && stream.Len() != 1010 {
+			t.Fatalf("expected unpadded stream, got %d bytes", stream.Len())
+		}
+		var received []byte
+		buffer := make([]byte, 2048)
+		for len(received) < 1010 {
+			n, err := reader.Read(&stream, buffer)
+			if err != nil {
+				t.Fatal(err)
+			}
+			received = append(received, buffer[:n]...)
+		}
+		if !bytes.Equal(received, bytes.Join(messages, nil)) {
+			t.Fatalf("padding frames %d: payload mismatch", paddingFrames)
+		}
+	}
+}
+
+func TestParsePaddingTypeRequest(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		request       string
+		legacyPadding bool
+		expected      PaddingType
+		supported     bool
+	}{
+		{request: "1, 0", expected: PaddingTypeVariant1, supported: true},
+		{request: "0, 1", expected: PaddingTypeNone, supported: true},
+		{request: "2, 1", expected: PaddingTypeVariant1, supported: true},
+		{request: "2", supported: false},
+		{legacyPadding: true, expected: PaddingTypeVariant1, supported: true},
+		{expected: PaddingTypeNone, supported: true},
+	} {
+		paddingType, supported := ParsePaddingTypeRequest(testCase.request, testCase.legacyPadding)
+		if supported != testCase.supported || paddingType != testCase.expected {
+			t.Fatalf("request %q legacy %v: got %d %v", testCase.request, testCase.legacyPadding, paddingType, supported)
+		}
+	}
+}
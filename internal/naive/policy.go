@@ -0,0 +1,135 @@
+package naive
+
+import (
+	"math/rand"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+const (
+	maxPaddingSize = 255
+	// minPaddingHeaderLength covers the random prefix of the Padding header.
+	minPaddingHeaderLength = 16
+	maxPaddingHeaderLength = 1024
+)
+
+// PaddingPolicy shapes the padding of naive connections. The zero value is
+// the naiveproxy default: the first 8 frames in each direction are padded
+// with uniform sizes in [0, 255].
+//
+// Frames, and whether LaterSizes is set, decide which frames carry a padding
+// header, so the server must use the same values, or it will misread the
+// stream. The padding sizes are sent in each frame header and the Padding
+// header is never parsed, so Sizes, the LaterSizes buckets and the header
+// length may differ between the peers.
+type PaddingPolicy struct {
+	// Frames is the number of padded frames in each direction. Defaults to 8.
+	Frames int
+	// Sizes is the size distribution for the first Frames frames. Defaults
+	// to a single bucket covering [0, 255].
+	Sizes []PaddingSizeBucket
+	// LaterSizes, if set, keeps padding the frames after the first Frames
+	// frames, with sizes drawn from these buckets. Setting it must match the
+	// peer; the buckets themselves need not.
+	LaterSizes []PaddingSizeBucket
+	// HeaderMinLength and HeaderMaxLength bound the length of the Padding
+	// header. Default to 30 and 61.
+	HeaderMinLength int
+	HeaderMaxLength int
+}
+
+// PaddingSizeBucket is a bucket of a histogram-shaped padding size profile.
+// A bucket is chosen with probability proportional to Weight, then a size is
+// drawn uniformly from [Min, Max]. A single bucket is a uniform distribution.
+type PaddingSizeBucket struct {
+	Min    int
+	Max    int
+	Weight int
+}
+
+// Validate checks the policy and returns it with defaults applied. A nil
+// policy returns the default policy.
+func (p *PaddingPolicy) Validate() (*PaddingPolicy, error) {
+	var policy PaddingPolicy
+	if p != nil {
+		policy = *p
+	}
+	if policy.Frames < 0 {
+		return nil, E.New("padding policy: negative frame count")
+	}
+	if policy.Frames == 0 {
+		policy.Frames = PaddingCount
+	}
+	if len(policy.Sizes) == 0 {
+		policy.Sizes = []PaddingSizeBucket{{Max: maxPaddingSize, Weight: 1}}
+	}
+	err := validateSizeBuckets(policy.Sizes)
+	if err != nil {
+		return nil, E.Cause(err, "padding policy: sizes")
+	}
+	err = validateSizeBuckets(policy.LaterSizes)
+	if err != nil {
+		return nil, E.Cause(err, "padding policy: later sizes")
+	}
+	if policy.HeaderMinLength == 0 && policy.HeaderMaxLength == 0 {
+		policy.HeaderMinLength = 30
+		policy.HeaderMaxLength = 61
+	}
+	if policy.HeaderMinLength < minPaddingHeaderLength || policy.HeaderMaxLength > maxPaddingHeaderLength || policy.HeaderMinLength > policy.HeaderMaxLength {
+		return nil, E.New("padding policy: header length must be within [", minPaddingHeaderLength, ", ", maxPaddingHeaderLength, "]")
+	}
+	return &policy, nil
+}
+
+func validateSizeBuckets(buckets []PaddingSizeBucket) error {
+	for _, bucket := range buckets {
+		if bucket.Min < 0 || bucket.Max > maxPaddingSize || bucket.Min > bucket.Max {
+			return E.New("bucket [", bucket.Min, ", ", bucket.Max, "] out of range [0, ", maxPaddingSize, "]")
+		}
+		if bucket.Weight <= 0 {
+			return E.New("bucket [", bucket.Min, ", ", bucket.Max, "] must have positive weight")
+		}
+	}
+	return nil
+}
+
+func samplePaddingSize(buckets []PaddingSizeBucket) int {
+	if len(buckets) == 0 {
+		return rand.Intn(maxPaddingSize + 1)
+	}
+	bucket := buckets[0]
+	if len(buckets) > 1 {
+		var totalWeight int
+		for _, bucket := range buckets {
+			totalWeight += bucket.Weight
+		}
+		choice := rand.Intn(totalWeight)
+		for _, bucket = range buckets {
+			if choice < bucket.Weight {
+				break
+			}
+			choice -= bucket.Weight
+		}
+	}
+	return bucket.Min + rand.Intn(bucket.Max-bucket.Min+1)
+}
+
+// GenerateHeader returns a Padding header value within the header length
+// range. A nil policy uses the default range.
+func (p *PaddingPolicy) GenerateHeader() string {
+	minLength, maxLength := 30, 61
+	if p != nil && p.HeaderMaxLength > 0 {
+		minLength, maxLength = p.HeaderMinLength, p.HeaderMaxLength
+	}
+	paddingLen := minLength + rand.Intn(maxLength-minLength+1)
+	padding := make([]byte, paddingLen)
+	bits := rand.Uint64()
+	for i := 0; i < 16; i++ {
+		padding[i] = "!#$()+<>?@[]^`{}"[bits&15]
+		bits >>= 4
+	}
+	for i := 16; i < paddingLen; i++ {
+		padding[i] = '~'
+	}
+	return string(padding)
+}
@@ -0,0 +1,98 @@
+package naive
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPaddingPolicyValidate(t *testing.T) {
+	t.Parallel()
+	policy, err := (*PaddingPolicy)(nil).Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Frames != PaddingCount || len(policy.Sizes) != 1 || policy.HeaderMinLength != 30 || policy.HeaderMaxLength != 61 {
+		t.Fatalf("unexpected default policy %+v", policy)
+	}
+	for _, invalid := range []PaddingPolicy{
+		{Frames: -1},
+		{Sizes: []PaddingSizeBucket{{Min: 0, Max: 256, Weight: 1}}},
+		{Sizes: []PaddingSizeBucket{{Min: 10, Max: 5, Weight: 1}}},
+		{Sizes: []PaddingSizeBucket{{Min: 0, Max: 5}}},
+		{LaterSizes: []PaddingSizeBucket{{Min: -1, Max: 5, Weight: 1}}},
+		{HeaderMinLength: 8, HeaderMaxLength: 20},
+		{HeaderMinLength: 40, HeaderMaxLength: 30},
+	} {
+		_, err = invalid.Validate()
+		if err == nil {
+			t.Fatalf("expected error for %+v", invalid)
+		}
+	}
+}
+
+func TestPaddingPolicySizes(t *testing.T) {
+	t.Parallel()
+	buckets := []PaddingSizeBucket{{Min: 0, Max: 0, Weight: 1}, {Min: 100, Max: 110, Weight: 3}}
+	seen := make(map[bool]int)
+	for i := 0; i < 1000; i++ {
+		size := samplePaddingSize(buckets)
+		if size != 0 && (size < 100 || size > 110) {
+			t.Fatalf("size %d outside buckets", size)
+		}
+		seen[size == 0]++
+	}
+	if seen[true] == 0 || seen[false] < seen[true] {
+		t.Fatalf("unexpected bucket distribution %v", seen)
+	}
+}
+
+func TestPaddingPolicyHeader(t *testing.T) {
+	t.Parallel()
+	policy, err := (&PaddingPolicy{HeaderMinLength: 100, HeaderMaxLength: 120}).Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		header := policy.GenerateHeader()
+		if len(header) < 100 || len(header) > 120 {
+			t.Fatalf("header length %d outside range", len(header))
+		}
+	}
+}
+
+func TestPaddingPolicyLaterFrames(t *testing.T) {
+	t.Parallel()
+	policy, err := (&PaddingPolicy{
+		Frames:     2,
+		Sizes:      []PaddingSizeBucket{{Min: 255, Max: 255, Weight: 1}},
+		LaterSizes: []PaddingSizeBucket{{Min: 1, Max: 1, Weight: 1}},
+	}).Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stream bytes.Buffer
+	writer := NewPaddingConn(policy)
+	reader := NewPaddingConn(policy)
+	for i := 0; i < 4; i++ {
+		_, err = writer.Write(&stream, []byte("data"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if expected := 2*(3+4+255) + 2*(3+4+1); stream.Len() != expected {
+		t.Fatalf("expected %d bytes, got %d", expected, stream.Len())
+	}
+	if writer.WriterReplaceable() {
+		t.Fatal("writer with later padding must not be replaceable")
+	}
+	buffer := make([]byte, 16)
+	for i := 0; i < 4; i++ {
+		n, err := reader.Read(&stream, buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buffer[:n]) != "data" {
+			t.Fatalf("unexpected frame %q", buffer[:n])
+		}
+	}
+}
@@ -11,12 +11,14 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/sagernet/cronet-go/internal/naive"
 	"github.com/sagernet/sing/common/bufio"
 	E "github.com/sagernet/sing/common/exceptions"
 	F "github.com/sagernet/sing/common/format"
 	"github.com/sagernet/sing/common/logger"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
+	"github.com/sagernet/sing/common/uot"
 )
 
 var _ N.Dialer = (*NaiveClient)(nil)
@@ -50,6 +52,7 @@ type NaiveClient struct {
 	serverName               string
 	serverURL                string
 	authorization            string
+	credentialCache          *proxyCredentialCache
 	concurrency              int
 	extraHeaders             map[string]string
 	receiveWindow            uint64
@@ -58,11 +61,15 @@ type NaiveClient struct {
 	echEnabled               bool
 	echConfigList            []byte
 	echQueryServerName       string
+	echRefresh               bool
 	echMutex                 sync.RWMutex
 	testForceUDPLoopback     bool
 	quicEnabled              bool
 	quicCongestionControl    QUICCongestionControl
 	quicSessionReceiveWindow uint64
+	uotClient                *uot.Client
+	connectUDP               bool
+	connectUDPTemplate       string
 	counter                  atomic.Uint64
 	started                  chan struct{}
 	engine                   Engine
@@ -70,6 +77,21 @@ type NaiveClient struct {
 	activeConnections        sync.WaitGroup
 	proxyWaitGroup           sync.WaitGroup
 	proxyCancel              context.CancelFunc
+	paddingPolicy            *PaddingPolicy
+	socketAccess             sync.Mutex
+	socketBindings           map[*naiveSocketBinding]struct{}
+	writeBatching            *WriteBatchOptions
+	earlyData                bool
+}
+
+// naiveSocketBinding tracks the server sockets the engine opens while a
+// stream waits to become ready.
+type naiveSocketBinding struct {
+	local  net.Addr
+	remote net.Addr
+	dials  int
+	shared bool
+	ready  bool
 }
 
 type NaiveClientOptions struct {
@@ -88,10 +110,39 @@ type NaiveClientOptions struct {
 	ECHEnabled               bool
 	ECHConfigList            []byte
 	ECHQueryServerName       string
+	ECHRefresh               bool
 	TestForceUDPLoopback     bool
 	QUIC                     bool
 	QUICCongestionControl    QUICCongestionControl
 	QUICSessionReceiveWindow uint64
+	// UDPOverTCPVersion selects the UDP-over-TCP protocol version used by
+	// ListenPacket and DialContext("udp"). Defaults to uot.Version.
+	UDPOverTCPVersion uint8
+	// ConnectUDP makes ListenPacket and DialContext("udp") use MASQUE
+	// CONNECT-UDP (RFC 9298) instead of UDP-over-TCP. The server must support
+	// extended CONNECT and HTTP Datagrams carried in capsules.
+	ConnectUDP bool
+	// ConnectUDPTemplate is the CONNECT-UDP URI template. It defaults to the
+	// well-known template on the server.
+	ConnectUDPTemplate string
+	// CredentialProvider supplies the proxy-authorization credential for new
+	// connections instead of Username and Password. A credential rejected
+	// with 407 is refreshed, and DialContext retries once with the new one.
+	CredentialProvider ProxyCredentialProvider
+	// PaddingPolicy shapes the padding of TCP connections. Defaults to the
+	// naiveproxy padding. Policies that change Frames or set LaterSizes need
+	// a server configured with the same values; sizes need not match.
+	PaddingPolicy *PaddingPolicy
+	// WriteBatching, if set, batches writes of TCP connections, trading a
+	// little latency for fewer frames and native calls. See
+	// BidirectionalConn.DisableAutoFlush; connections implement Flusher.
+	WriteBatching *WriteBatchOptions
+	// EarlyData makes DialEarly connections send the first write without
+	// waiting for the CONNECT response: with the request headers in one
+	// packet on QUIC, and right after the stream is ready on HTTP/2. The
+	// response is checked on the first read. Early data is always padded,
+	// so the server must support padding.
+	EarlyData bool
 }
 
 func NewNaiveClient(config NaiveClientOptions) (*NaiveClient, error) {
@@ -109,6 +160,17 @@ func NewNaiveClient(config NaiveClientOptions) (*NaiveClient, error) {
 		return nil, E.New("insecure concurrency is not supported with QUIC")
 	}
 
+	paddingPolicy, err := config.PaddingPolicy.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.UDPOverTCPVersion {
+	case 0, uot.Version, uot.LegacyVersion:
+	default:
+		return nil, E.New("unknown UDP-over-TCP version: ", config.UDPOverTCPVersion)
+	}
+
 	serverName := config.ServerName
 	if serverName == "" {
 		serverName = config.ServerAddress.AddrString()
@@ -145,7 +207,7 @@ func NewNaiveClient(config NaiveClientOptions) (*NaiveClient, error) {
 		l = logger.NOP()
 	}
 
-	return &NaiveClient{
+	client := &NaiveClient{
 		ctx:                      ctx,
 		dialer:                   dialer,
 		logger:                   l,
@@ -160,13 +222,30 @@ func NewNaiveClient(config NaiveClientOptions) (*NaiveClient, error) {
 		echEnabled:               config.ECHEnabled,
 		echConfigList:            config.ECHConfigList,
 		echQueryServerName:       config.ECHQueryServerName,
+		echRefresh:               config.ECHEnabled && config.ECHRefresh,
 		testForceUDPLoopback:     config.TestForceUDPLoopback,
 		quicEnabled:              config.QUIC,
 		quicCongestionControl:    config.QUICCongestionControl,
 		receiveWindow:            config.ReceiveWindow,
 		quicSessionReceiveWindow: config.QUICSessionReceiveWindow,
 		started:                  make(chan struct{}),
-	}, nil
+		socketBindings:           make(map[*naiveSocketBinding]struct{}),
+		paddingPolicy:            paddingPolicy,
+		writeBatching:            config.WriteBatching,
+		earlyData:                config.EarlyData,
+	}
+	if config.CredentialProvider != nil {
+		client.credentialCache = newProxyCredentialCache(config.CredentialProvider)
+	}
+	client.uotClient = &uot.Client{Dialer: client, Version: config.UDPOverTCPVersion}
+	if config.ConnectUDP {
+		client.connectUDP = true
+		client.connectUDPTemplate = config.ConnectUDPTemplate
+		if client.connectUDPTemplate == "" {
+			client.connectUDPTemplate = client.serverURL + connectUDPDefaultPath
+		}
+	}
+	return client, nil
 }
 
 func (c *NaiveClient) Start() error {
@@ -246,6 +325,7 @@ func (c *NaiveClient) Start() error {
 			c.logger.ErrorContext(c.ctx, "open TCP connection to ", destination, ": ", err)
 			return toNetError(err).Code()
 		}
+		c.recordSocket(conn)
 
 		if tcpConn, ok := N.CastReader[*net.TCPConn](conn); ok {
 			fd, duplicateError := dupSocketFD(tcpConn)
@@ -300,6 +380,7 @@ func (c *NaiveClient) Start() error {
 			c.logger.ErrorContext(c.ctx, "open UDP connection to ", destination, ": ", err)
 			return toNetError(err).Code(), "", 0
 		}
+		c.recordSocket(conn)
 
 		localAddr := M.SocksaddrFromNet(conn.LocalAddr())
 		if localAddr.IsValid() {
@@ -399,6 +480,14 @@ func (c *NaiveClient) Start() error {
 	c.engine = engine
 	c.streamEngine = engine.StreamEngine()
 
+	if c.echRefresh {
+		c.proxyWaitGroup.Add(1)
+		go func() {
+			defer c.proxyWaitGroup.Done()
+			c.loopRefreshECHConfig(proxyContext)
+		}()
+	}
+
 	c.state.Store(uint32(clientStateRunning))
 	close(c.started)
 	return nil
@@ -411,28 +500,45 @@ func (c *NaiveClient) Engine() Engine {
 	return c.engine
 }
 
-func (c *NaiveClient) DialEarly(ctx context.Context, destination M.Socksaddr) (NaiveConn, error) {
+// waitStarted waits for a pending Start and reports whether the client is running.
+func (c *NaiveClient) waitStarted() error {
 	state := clientState(c.state.Load())
 	switch state {
 	case clientStateRunning:
 	case clientStateClosed, clientStateClosing:
-		return nil, net.ErrClosed
+		return net.ErrClosed
 	default:
 		select {
 		case <-c.started:
 			if clientState(c.state.Load()) != clientStateRunning {
-				return nil, net.ErrClosed
+				return net.ErrClosed
 			}
 		case <-c.ctx.Done():
-			return nil, c.ctx.Err()
+			return c.ctx.Err()
 		}
 	}
+	return nil
+}
+
+func (c *NaiveClient) DialEarly(ctx context.Context, destination M.Socksaddr) (NaiveConn, error) {
+	err := c.waitStarted()
+	if err != nil {
+		return nil, err
+	}
+	authorization, err := c.proxyAuthorization(ctx)
+	if err != nil {
+		return nil, err
+	}
 	headers := map[string]string{
-		"-connect-authority": destination.String(),
-		"Padding":            generatePaddingHeader(),
+		"-connect-authority":   destination.String(),
+		"Padding":              c.paddingPolicy.GenerateHeader(),
+		"Padding-Type-Request": naive.PaddingTypeRequest,
 	}
-	if c.authorization != "" {
-		headers["proxy-authorization"] = c.authorization
+	if c.earlyData {
+		headers["Padding-Type-Request"] = naive.PaddingTypeRequestVariant1
+	}
+	if authorization != "" {
+		headers["proxy-authorization"] = authorization
 	}
 	if c.quicEnabled {
 		headers["-force-quic"] = "true"
@@ -445,24 +551,65 @@ func (c *NaiveClient) DialEarly(ctx context.Context, destination M.Socksaddr) (N
 		concurrencyIndex := int(c.counter.Add(1) % uint64(c.concurrency))
 		headers["-network-isolation-key"] = F.ToString("https://pool-", concurrencyIndex, ":443")
 	}
-	conn := c.streamEngine.CreateConn(ctx, c.logger, true, true)
-	err := conn.Start("CONNECT", c.serverURL, headers, 0, false)
+	conn := c.streamEngine.CreateConn(ctx, c.logger, true, !c.earlyData)
+	if c.earlyData && c.quicEnabled {
+		conn.DelayRequestHeadersUntilFlush()
+	}
+	conn.setRemoteAddr(destination)
+	binding := c.bindSocket()
+	conn.socketAddrs = func() (net.Addr, net.Addr, bool) {
+		return c.socketAddrs(binding)
+	}
+	conn.onReady = func() {
+		c.unbindSocket(binding, true)
+	}
+	if c.writeBatching != nil {
+		conn.DisableAutoFlush(*c.writeBatching)
+	}
+	err = conn.Start("CONNECT", c.serverURL, headers, 0, false)
 	if err != nil {
+		c.unbindSocket(binding, false)
 		return nil, err
 	}
 	trackedConn := &trackedNaiveConn{
-		NaiveConn: NewNaiveConn(ctx, conn, c.logger),
-		client:    c,
+		NaiveConn:     newNaiveConn(ctx, conn, c.logger, c.paddingPolicy, c.earlyData),
+		client:        c,
+		authorization: authorization,
 	}
 	c.activeConnections.Add(1)
-	conn.setOnTerminate(trackedConn.release)
+	conn.setOnTerminate(func() {
+		c.unbindSocket(binding, false)
+		trackedConn.release()
+	})
 	return trackedConn, nil
 }
 
+// DialContext dials destination through the proxy. UDP connections are carried
+// over a CONNECT stream using UDP-over-TCP in connect mode.
 func (c *NaiveClient) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
-	if N.NetworkName(network) != N.NetworkTCP {
+	switch N.NetworkName(network) {
+	case N.NetworkTCP:
+	case N.NetworkUDP:
+		if c.connectUDP {
+			packetConn, err := c.listenConnectUDP(ctx, destination)
+			if err != nil {
+				return nil, err
+			}
+			return packetConn, nil
+		}
+		return c.uotClient.DialContext(ctx, network, destination)
+	default:
 		return nil, os.ErrInvalid
 	}
+	conn, err := c.dialTCP(ctx, destination)
+	if errors.Is(err, ErrProxyAuthenticationRequired) && c.credentialCache != nil {
+		c.logger.DebugContext(ctx, "proxy credential rejected, retry with a refreshed credential")
+		conn, err = c.dialTCP(ctx, destination)
+	}
+	return conn, err
+}
+
+func (c *NaiveClient) dialTCP(ctx context.Context, destination M.Socksaddr) (net.Conn, error) {
 	conn, err := c.DialEarly(ctx, destination)
 	if err != nil {
 		return nil, err
@@ -475,8 +622,18 @@ func (c *NaiveClient) DialContext(ctx context.Context, network string, destinati
 	return conn, nil
 }
 
+// ListenPacket opens a UDP-over-TCP session in non-connect mode, so every
+// packet carries its own destination and source address. With ConnectUDP,
+// the session is a CONNECT-UDP stream bound to destination instead.
 func (c *NaiveClient) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
-	return nil, os.ErrInvalid
+	if c.connectUDP {
+		packetConn, err := c.listenConnectUDP(ctx, destination)
+		if err != nil {
+			return nil, err
+		}
+		return packetConn, nil
+	}
+	return c.uotClient.ListenPacket(ctx, destination)
 }
 
 func (c *NaiveClient) Close() error {
@@ -527,16 +684,81 @@ func (c *NaiveClient) doClose() error {
 	return nil
 }
 
+// UpdateECHConfigList replaces the ECH config list used for new connections.
+// Existing tunnels are not affected. Chromium caches the HTTPS record it was
+// given for up to five minutes, so sessions created within that time may
+// still use the previous config.
+func (c *NaiveClient) UpdateECHConfigList(echConfigList []byte) error {
+	if !c.echEnabled {
+		return E.New("ECH is not enabled")
+	}
+	echConfigList = append([]byte(nil), echConfigList...)
+	c.echMutex.Lock()
+	c.echConfigList = echConfigList
+	c.echMutex.Unlock()
+	return nil
+}
+
 func (c *NaiveClient) getECHConfigList() []byte {
 	c.echMutex.RLock()
 	defer c.echMutex.RUnlock()
 	return c.echConfigList
 }
 
+// bindSocket starts tracking the server sockets opened for a new stream.
+func (c *NaiveClient) bindSocket() *naiveSocketBinding {
+	binding := &naiveSocketBinding{}
+	c.socketAccess.Lock()
+	c.socketBindings[binding] = struct{}{}
+	c.socketAccess.Unlock()
+	return binding
+}
+
+// unbindSocket stops tracking the stream once it is ready, or once it failed
+// before that.
+func (c *NaiveClient) unbindSocket(binding *naiveSocketBinding, ready bool) {
+	c.socketAccess.Lock()
+	if _, loaded := c.socketBindings[binding]; loaded {
+		delete(c.socketBindings, binding)
+		binding.ready = ready
+	}
+	c.socketAccess.Unlock()
+}
+
+// recordSocket counts a server socket opened by the engine against every
+// stream waiting to become ready.
+func (c *NaiveClient) recordSocket(conn net.Conn) {
+	c.socketAccess.Lock()
+	defer c.socketAccess.Unlock()
+	for binding := range c.socketBindings {
+		binding.dials++
+		if len(c.socketBindings) > 1 {
+			binding.shared = true
+			continue
+		}
+		binding.local = conn.LocalAddr()
+		binding.remote = conn.RemoteAddr()
+	}
+}
+
+// socketAddrs returns the addresses of the socket opened for the stream. The
+// socket is only known to carry the stream if it is the one socket opened
+// while the stream, and no other, waited to become ready.
+func (c *NaiveClient) socketAddrs(binding *naiveSocketBinding) (net.Addr, net.Addr, bool) {
+	c.socketAccess.Lock()
+	defer c.socketAccess.Unlock()
+	if !binding.ready || binding.shared || binding.dials != 1 {
+		return nil, nil, false
+	}
+	return binding.local, binding.remote, true
+}
+
 type trackedNaiveConn struct {
 	NaiveConn
-	client    *NaiveClient
-	closeOnce sync.Once
+	client        *NaiveClient
+	authorization string
+	closeOnce     sync.Once
+	rejectOnce    sync.Once
 }
 
 func (c *trackedNaiveConn) release() {
@@ -545,11 +767,52 @@ func (c *trackedNaiveConn) release() {
 	})
 }
 
+// checkRejected drops the credential of the connection from the cache once
+// the server rejected it, whether the handshake or the first read saw the
+// response.
+func (c *trackedNaiveConn) checkRejected(err error) {
+	if err != nil && errors.Is(err, ErrProxyAuthenticationRequired) {
+		c.rejectOnce.Do(func() {
+			c.client.rejectProxyAuthorization(c.authorization)
+		})
+	}
+}
+
+func (c *trackedNaiveConn) Handshake() error {
+	err := c.NaiveConn.Handshake()
+	c.checkRejected(err)
+	return err
+}
+
+func (c *trackedNaiveConn) HandshakeContext(ctx context.Context) error {
+	err := c.NaiveConn.HandshakeContext(ctx)
+	c.checkRejected(err)
+	return err
+}
+
+func (c *trackedNaiveConn) Read(p []byte) (n int, err error) {
+	n, err = c.NaiveConn.Read(p)
+	c.checkRejected(err)
+	return
+}
+
 func (c *trackedNaiveConn) Close() error {
 	c.release()
 	return c.NaiveConn.Close()
 }
 
+func (c *trackedNaiveConn) Flush() error {
+	return c.NaiveConn.(*naiveConn).Flush()
+}
+
+func (c *trackedNaiveConn) CloseWrite() error {
+	return c.NaiveConn.(*naiveConn).CloseWrite()
+}
+
+func (c *trackedNaiveConn) SocketAddrs() (local net.Addr, remote net.Addr, loaded bool) {
+	return c.NaiveConn.(*naiveConn).SocketAddrs()
+}
+
 func (c *trackedNaiveConn) Upstream() any {
 	return c.NaiveConn
 }
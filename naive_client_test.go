@@ -0,0 +1,99 @@
+package cronet
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNaiveClientSocketBinding(t *testing.T) {
+	newClient := func() *NaiveClient {
+		return &NaiveClient{socketBindings: make(map[*naiveSocketBinding]struct{})}
+	}
+	socket := func(port int) net.Conn {
+		return &addrConn{
+			local:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port},
+			remote: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 443},
+		}
+	}
+
+	t.Run("own socket", func(t *testing.T) {
+		c := newClient()
+		binding := c.bindSocket()
+		c.recordSocket(socket(1000))
+		if _, _, loaded := c.socketAddrs(binding); loaded {
+			t.Error("socket reported before the stream was ready")
+		}
+		c.unbindSocket(binding, true)
+		local, remote, loaded := c.socketAddrs(binding)
+		if !loaded || local.(*net.TCPAddr).Port != 1000 || remote.(*net.TCPAddr).Port != 443 {
+			t.Errorf("unexpected socket: %v %v %v", local, remote, loaded)
+		}
+		c.recordSocket(socket(1001))
+		if local, _, _ := c.socketAddrs(binding); local.(*net.TCPAddr).Port != 1000 {
+			t.Error("socket opened after the stream was ready was attributed to it")
+		}
+	})
+
+	t.Run("reused socket", func(t *testing.T) {
+		c := newClient()
+		binding := c.bindSocket()
+		c.unbindSocket(binding, true)
+		if _, _, loaded := c.socketAddrs(binding); loaded {
+			t.Error("stream without a socket of its own reported one")
+		}
+	})
+
+	t.Run("concurrent streams", func(t *testing.T) {
+		c := newClient()
+		first := c.bindSocket()
+		second := c.bindSocket()
+		c.recordSocket(socket(1000))
+		c.unbindSocket(first, true)
+		c.unbindSocket(second, true)
+		if _, _, loaded := c.socketAddrs(first); loaded {
+			t.Error("socket shared by waiting streams was attributed to the first")
+		}
+		if _, _, loaded := c.socketAddrs(second); loaded {
+			t.Error("socket shared by waiting streams was attributed to the second")
+		}
+	})
+
+	t.Run("several sockets", func(t *testing.T) {
+		c := newClient()
+		binding := c.bindSocket()
+		c.recordSocket(socket(1000))
+		c.recordSocket(socket(1001))
+		c.unbindSocket(binding, true)
+		if _, _, loaded := c.socketAddrs(binding); loaded {
+			t.Error("stream racing several sockets reported one")
+		}
+	})
+
+	t.Run("failed stream", func(t *testing.T) {
+		c := newClient()
+		binding := c.bindSocket()
+		c.recordSocket(socket(1000))
+		c.unbindSocket(binding, false)
+		c.unbindSocket(binding, true)
+		if _, _, loaded := c.socketAddrs(binding); loaded {
+			t.Error("stream failed before ready reported a socket")
+		}
+		if len(c.socketBindings) != 0 {
+			t.Error("binding was not released")
+		}
+	})
+}
+
+type addrConn struct {
+	net.Conn
+	local  net.Addr
+	remote net.Addr
+}
+
+func (c *addrConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *addrConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -2,207 +2,155 @@ package cronet
 
 import (
 	"context"
-	"encoding/binary"
-	"io"
-	"math/rand"
 	"net"
+	"sync"
+	"sync/atomic"
 
-	"github.com/sagernet/sing/common"
+	"github.com/sagernet/cronet-go/internal/naive"
 	"github.com/sagernet/sing/common/baderror"
 	"github.com/sagernet/sing/common/buf"
 	E "github.com/sagernet/sing/common/exceptions"
 	"github.com/sagernet/sing/common/logger"
-	"github.com/sagernet/sing/common/rw"
+	N "github.com/sagernet/sing/common/network"
 )
 
-const (
-	paddingCount        = 8
-	maxPaddingChunkSize = 65535
-)
+type NaiveConn interface {
+	net.Conn
+	Handshake() error
+	HandshakeContext(ctx context.Context) error
+}
 
-func generatePaddingHeader() string {
-	paddingLen := rand.Intn(32) + 30
-	padding := make([]byte, paddingLen)
-	bits := rand.Uint64()
-	for i := 0; i < 16; i++ {
-		padding[i] = "!#$()+<>?@[]^`{}"[bits&15]
-		bits >>= 4
-	}
-	for i := 16; i < paddingLen; i++ {
-		padding[i] = '~'
-	}
-	return string(padding)
+// SocketAddrsConn is implemented by connections that can report the socket
+// carrying them, such as the connections of NaiveClient and NaivePool. See
+// BidirectionalConn.SocketAddrs.
+type SocketAddrsConn interface {
+	SocketAddrs() (local net.Addr, remote net.Addr, loaded bool)
 }
 
-type paddingConn struct {
-	readPadding      int
-	writePadding     int
-	readRemaining    int
-	paddingRemaining int
+// Flusher is implemented by connections that may queue writes, such as the
+// connections of NaiveClient and NaivePool with write batching. See
+// BidirectionalConn.Flush.
+type Flusher interface {
+	Flush() error
 }
 
-func (p *paddingConn) readWithPadding(reader io.Reader, buffer []byte) (n int, err error) {
-	if p.readRemaining > 0 {
-		if len(buffer) > p.readRemaining {
-			buffer = buffer[:p.readRemaining]
-		}
-		n, err = reader.Read(buffer)
-		if err != nil {
-			return
-		}
-		p.readRemaining -= n
-		return
-	}
-	if p.paddingRemaining > 0 {
-		err = rw.SkipN(reader, p.paddingRemaining)
-		if err != nil {
-			return
-		}
-		p.paddingRemaining = 0
-	}
-	if p.readPadding < paddingCount {
-		var paddingHeader []byte
-		if len(buffer) >= 3 {
-			paddingHeader = buffer[:3]
-		} else {
-			paddingHeader = make([]byte, 3)
-		}
-		_, err = io.ReadFull(reader, paddingHeader)
-		if err != nil {
-			return
-		}
-		originalDataSize := int(binary.BigEndian.Uint16(paddingHeader[:2]))
-		paddingSize := int(paddingHeader[2])
-		if len(buffer) > originalDataSize {
-			buffer = buffer[:originalDataSize]
-		}
-		n, err = reader.Read(buffer)
-		if err != nil {
-			return
-		}
-		p.readPadding++
-		p.readRemaining = originalDataSize - n
-		p.paddingRemaining = paddingSize
-		return
-	}
-	return reader.Read(buffer)
-}
-
-func (p *paddingConn) writeWithPadding(writer io.Writer, data []byte) (n int, err error) {
-	if p.writePadding < paddingCount {
-		paddingSize := rand.Intn(256)
-		buffer := buf.NewSize(3 + len(data) + paddingSize)
-		defer buffer.Release()
-		header := buffer.Extend(3)
-		binary.BigEndian.PutUint16(header, uint16(len(data)))
-		header[2] = byte(paddingSize)
-		common.Must1(buffer.Write(data))
-		if paddingSize > 0 {
-			common.Must(buffer.WriteZeroN(paddingSize))
-		}
-		_, err = writer.Write(buffer.Bytes())
-		if err == nil {
-			n = len(data)
-		}
-		p.writePadding++
-		return
-	}
-	return writer.Write(data)
+var (
+	_ SocketAddrsConn = (*naiveConn)(nil)
+	_ SocketAddrsConn = (*trackedNaiveConn)(nil)
+	_ SocketAddrsConn = (*naivePoolConn)(nil)
+	_ N.WriteCloser   = (*naiveConn)(nil)
+	_ N.WriteCloser   = (*trackedNaiveConn)(nil)
+	_ N.WriteCloser   = (*naivePoolConn)(nil)
+	_ Flusher         = (*naiveConn)(nil)
+	_ Flusher         = (*trackedNaiveConn)(nil)
+	_ Flusher         = (*naivePoolConn)(nil)
+)
+
+type naiveConn struct {
+	net.Conn
+	ctx             context.Context
+	conn            *BidirectionalConn
+	logger          logger.ContextLogger
+	padding         naive.PaddingConn
+	paddingOnce     sync.Once
+	paddingErr      error
+	paddingResolved atomic.Bool
+	// earlyData connections write before the response arrives and commit to
+	// variant 1 padding.
+	earlyData        bool
+	handshakeOnce    sync.Once
+	handshakeErr     error
+	handshakeChecked atomic.Bool
 }
 
-func (p *paddingConn) writeBufferWithPadding(writer io.Writer, buffer *buf.Buffer) error {
-	if p.writePadding < paddingCount {
-		bufferLen := buffer.Len()
-		if bufferLen > maxPaddingChunkSize {
-			_, err := p.writeChunked(writer, buffer.Bytes())
-			return err
-		}
-		paddingSize := rand.Intn(256)
-		header := buffer.ExtendHeader(3)
-		binary.BigEndian.PutUint16(header, uint16(bufferLen))
-		header[2] = byte(paddingSize)
-		if paddingSize > 0 {
-			common.Must(buffer.WriteZeroN(paddingSize))
-		}
-		p.writePadding++
+// PaddingPolicy shapes the padding of naive connections. See
+// NaiveClientOptions.PaddingPolicy.
+type PaddingPolicy = naive.PaddingPolicy
+
+// PaddingSizeBucket is a bucket of a padding size profile.
+type PaddingSizeBucket = naive.PaddingSizeBucket
+
+func NewNaiveConn(ctx context.Context, conn *BidirectionalConn, l logger.ContextLogger) NaiveConn {
+	return newNaiveConn(ctx, conn, l, nil, false)
+}
+
+func newNaiveConn(ctx context.Context, conn *BidirectionalConn, l logger.ContextLogger, policy *PaddingPolicy, earlyData bool) *naiveConn {
+	naiveConn := &naiveConn{Conn: conn, ctx: ctx, conn: conn, logger: l, padding: naive.NewPaddingConn(policy), earlyData: earlyData}
+	if earlyData {
+		naiveConn.paddingResolved.Store(true)
 	}
-	return common.Error(writer.Write(buffer.Bytes()))
+	return naiveConn
 }
 
-func (p *paddingConn) writeChunked(writer io.Writer, data []byte) (n int, err error) {
-	for len(data) > 0 {
-		var chunk []byte
-		if len(data) > maxPaddingChunkSize {
-			chunk = data[:maxPaddingChunkSize]
-			data = data[maxPaddingChunkSize:]
-		} else {
-			chunk = data
-			data = nil
-		}
-		var written int
-		written, err = p.writeWithPadding(writer, chunk)
-		n += written
+// negotiatePadding applies the padding type chosen by the server. Until it
+// has run, the connection assumes variant 1 padding.
+func (c *naiveConn) negotiatePadding(headers map[string]string) error {
+	c.paddingOnce.Do(func() {
+		paddingType, err := naive.ParsePaddingTypeReply(headers)
 		if err != nil {
+			c.paddingErr = err
 			return
 		}
-	}
-	return
+		if paddingType == naive.PaddingTypeNone {
+			if c.earlyData {
+				c.paddingErr = E.New("server rejected padding of early data")
+				return
+			}
+			c.logger.DebugContext(c.ctx, "server does not support padding")
+			c.padding.Disable()
+		}
+		c.paddingResolved.Store(true)
+	})
+	return c.paddingErr
 }
 
-func (p *paddingConn) frontHeadroom() int {
-	if p.writePadding < paddingCount {
-		return 3
+// waitPadding waits for the response headers before the first padded frame
+// is read or written, so the negotiated padding type is known.
+func (c *naiveConn) waitPadding(deadline <-chan struct{}) error {
+	if c.paddingResolved.Load() {
+		return nil
 	}
-	return 0
-}
-
-func (p *paddingConn) rearHeadroom() int {
-	if p.writePadding < paddingCount {
-		return 255
+	err := c.conn.waitReady(true, deadline)
+	if err != nil {
+		return err
 	}
-	return 0
+	return c.negotiatePadding(c.conn.headers)
 }
 
-func (p *paddingConn) writerMTU() int {
-	if p.writePadding < paddingCount {
-		return maxPaddingChunkSize
+func (c *naiveConn) Handshake() error {
+	headers, err := c.conn.WaitForHeaders()
+	if err != nil {
+		c.logger.WarnContext(c.ctx, "handshake failed: ", err)
+		return err
 	}
-	return 0
-}
-
-func (p *paddingConn) readerReplaceable() bool {
-	return p.readPadding == paddingCount
-}
-
-func (p *paddingConn) writerReplaceable() bool {
-	return p.writePadding == paddingCount
+	return c.checkResponse(headers)
 }
 
-type NaiveConn interface {
-	net.Conn
-	Handshake() error
-	HandshakeContext(ctx context.Context) error
-}
-type naiveConn struct {
-	net.Conn
-	ctx    context.Context
-	conn   *BidirectionalConn
-	logger logger.ContextLogger
-	paddingConn
+func (c *naiveConn) HandshakeContext(ctx context.Context) error {
+	headers, err := c.conn.WaitForHeadersContext(ctx)
+	if err != nil {
+		c.logger.WarnContext(c.ctx, "handshake failed: ", err)
+		return err
+	}
+	return c.checkResponse(headers)
 }
 
-func NewNaiveConn(ctx context.Context, conn *BidirectionalConn, l logger.ContextLogger) NaiveConn {
-	return &naiveConn{Conn: conn, ctx: ctx, conn: conn, logger: l}
+// checkResponse verifies the response once and returns the result on every
+// later call.
+func (c *naiveConn) checkResponse(headers map[string]string) error {
+	c.handshakeOnce.Do(func() {
+		c.handshakeErr = c.verifyResponse(headers)
+		c.handshakeChecked.Store(true)
+	})
+	return c.handshakeErr
 }
 
-func (c *naiveConn) Handshake() error {
-	headers, err := c.conn.WaitForHeaders()
-	if err != nil {
-		c.logger.WarnContext(c.ctx, "handshake failed: ", err)
-		return err
+func (c *naiveConn) verifyResponse(headers map[string]string) error {
+	err := handshakeStatusError(headers[":status"])
+	if err == nil {
+		err = c.negotiatePadding(headers)
 	}
-	if headers[":status"] != "200" {
-		err = E.New("unexpected response status: ", headers[":status"])
+	if err != nil {
 		c.logger.WarnContext(c.ctx, "handshake failed: ", err)
 		return err
 	}
@@ -210,40 +158,121 @@ func (c *naiveConn) Handshake() error {
 	return nil
 }
 
-func (c *naiveConn) HandshakeContext(ctx context.Context) error {
-	headers, err := c.conn.WaitForHeadersContext(ctx)
+// waitHandshake verifies the response before the first read, for callers
+// that read without calling Handshake, such as early data connections.
+func (c *naiveConn) waitHandshake(deadline <-chan struct{}) error {
+	if c.handshakeChecked.Load() {
+		return c.handshakeErr
+	}
+	err := c.conn.sendDelayedHeaders(deadline)
 	if err != nil {
-		c.logger.WarnContext(c.ctx, "handshake failed: ", err)
 		return err
 	}
-	if headers[":status"] != "200" {
-		err = E.New("unexpected response status: ", headers[":status"])
-		c.logger.WarnContext(c.ctx, "handshake failed: ", err)
+	err = c.conn.waitReady(true, deadline)
+	if err != nil {
 		return err
 	}
-	c.logger.DebugContext(c.ctx, "handshake succeeded")
-	return nil
+	return c.checkResponse(c.conn.headers)
+}
+
+func handshakeStatusError(status string) error {
+	switch status {
+	case "200":
+		return nil
+	case "407":
+		return E.Cause(ErrProxyAuthenticationRequired, "unexpected response status: ", status)
+	default:
+		return E.New("unexpected response status: ", status)
+	}
 }
 
 func (c *naiveConn) Read(p []byte) (n int, err error) {
-	n, err = c.readWithPadding(c.Conn, p)
+	err = c.waitHandshake(c.conn.readDeadline.Wait())
+	if err != nil {
+		return 0, err
+	}
+	n, err = c.padding.Read(c.Conn, p)
 	return n, baderror.WrapH2(err)
 }
 
 func (c *naiveConn) Write(p []byte) (n int, err error) {
-	n, err = c.writeChunked(c.Conn, p)
+	err = c.waitPadding(c.conn.writeDeadline.Wait())
+	if err != nil {
+		return 0, err
+	}
+	n, err = c.padding.Write(c.Conn, p)
 	return n, baderror.WrapH2(err)
 }
 
 func (c *naiveConn) WriteBuffer(buffer *buf.Buffer) error {
 	defer buffer.Release()
-	err := c.writeBufferWithPadding(c.Conn, buffer)
+	err := c.waitPadding(c.conn.writeDeadline.Wait())
+	if err != nil {
+		return err
+	}
+	err = c.padding.WriteBuffer(c.Conn, buffer)
 	return baderror.WrapH2(err)
 }
 
-func (c *naiveConn) FrontHeadroom() int      { return c.frontHeadroom() }
-func (c *naiveConn) RearHeadroom() int       { return c.rearHeadroom() }
-func (c *naiveConn) WriterMTU() int          { return c.writerMTU() }
-func (c *naiveConn) Upstream() any           { return c.Conn }
-func (c *naiveConn) ReaderReplaceable() bool { return c.readerReplaceable() }
-func (c *naiveConn) WriterReplaceable() bool { return c.writerReplaceable() }
+// The accessors below report padded framing until padding is negotiated.
+
+func (c *naiveConn) FrontHeadroom() int {
+	if !c.paddingResolved.Load() {
+		return 3
+	}
+	return c.padding.FrontHeadroom()
+}
+
+func (c *naiveConn) RearHeadroom() int {
+	if !c.paddingResolved.Load() {
+		return 255
+	}
+	return c.padding.RearHeadroom()
+}
+
+func (c *naiveConn) WriterMTU() int {
+	if !c.paddingResolved.Load() {
+		return naive.MaxPaddingChunkSize
+	}
+	return c.padding.WriterMTU()
+}
+
+func (c *naiveConn) WriteVectorised(buffers []*buf.Buffer) error {
+	defer buf.ReleaseMulti(buffers)
+	err := c.waitPadding(c.conn.writeDeadline.Wait())
+	if err != nil {
+		return err
+	}
+	for _, buffer := range buffers {
+		_, err = c.padding.Write(c.Conn, buffer.Bytes())
+		if err != nil {
+			return baderror.WrapH2(err)
+		}
+	}
+	return nil
+}
+
+// Flush sends writes queued by write batching.
+func (c *naiveConn) Flush() error {
+	return baderror.WrapH2(c.conn.Flush())
+}
+
+// CloseWrite ends the upload of the tunnel, while the download stays open
+// until the server finishes it.
+func (c *naiveConn) CloseWrite() error {
+	return baderror.WrapH2(c.conn.CloseWrite())
+}
+
+func (c *naiveConn) SocketAddrs() (local net.Addr, remote net.Addr, loaded bool) {
+	return c.conn.SocketAddrs()
+}
+
+func (c *naiveConn) Upstream() any { return c.Conn }
+
+func (c *naiveConn) ReaderReplaceable() bool {
+	return c.paddingResolved.Load() && c.padding.ReaderReplaceable()
+}
+
+func (c *naiveConn) WriterReplaceable() bool {
+	return c.paddingResolved.Load() && c.padding.WriterReplaceable()
+}
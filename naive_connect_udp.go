@@ -0,0 +1,265 @@
+package cronet
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	F "github.com/sagernet/sing/common/format"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const (
+	connectUDPDefaultPath = "/.well-known/masque/udp/{target_host}/{target_port}/"
+	capsuleTypeDatagram   = 0x00
+	maxQUICVarint         = 1<<62 - 1
+	// maxDatagramCapsuleLength bounds a DATAGRAM capsule to a context ID and
+	// the largest possible UDP payload.
+	maxDatagramCapsuleLength = 8 + 65535
+)
+
+// expandConnectUDPTemplate expands the target_host and target_port variables
+// of a CONNECT-UDP URI template (RFC 9298 section 2). IPv6 colons are
+// percent-encoded as the template variables are simple string expansions.
+func expandConnectUDPTemplate(template string, destination M.Socksaddr) string {
+	targetHost := strings.ReplaceAll(url.PathEscape(destination.AddrString()), ":", "%3A")
+	return strings.NewReplacer(
+		"{target_host}", targetHost,
+		"{target_port}", strconv.Itoa(int(destination.Port)),
+	).Replace(template)
+}
+
+func (c *NaiveClient) listenConnectUDP(ctx context.Context, destination M.Socksaddr) (*connectUDPConn, error) {
+	err := c.waitStarted()
+	if err != nil {
+		return nil, err
+	}
+	if !destination.IsValid() || destination.Port == 0 {
+		return nil, E.New("CONNECT-UDP requires a destination with port")
+	}
+	authorization, err := c.proxyAuthorization(ctx)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]string{
+		":protocol":        "connect-udp",
+		"capsule-protocol": "?1",
+	}
+	if authorization != "" {
+		headers["proxy-authorization"] = authorization
+	}
+	if c.quicEnabled {
+		headers["-force-quic"] = "true"
+	}
+	for key, value := range c.extraHeaders {
+		headers[key] = value
+	}
+	if c.concurrency > 1 {
+		concurrencyIndex := int(c.counter.Add(1) % uint64(c.concurrency))
+		headers["-network-isolation-key"] = F.ToString("https://pool-", concurrencyIndex, ":443")
+	}
+	conn := c.streamEngine.CreateConn(ctx, c.logger, true, true)
+	err = conn.Start("CONNECT", expandConnectUDPTemplate(c.connectUDPTemplate, destination), headers, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	c.activeConnections.Add(1)
+	packetConn := &connectUDPConn{
+		conn:        conn,
+		reader:      bufio.NewReader(conn),
+		destination: destination,
+		client:      c,
+	}
+	conn.setOnTerminate(packetConn.release)
+	responseHeaders, err := conn.WaitForHeadersContext(ctx)
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+	statusCode, _ := strconv.Atoi(responseHeaders[":status"])
+	if statusCode == 407 {
+		c.rejectProxyAuthorization(authorization)
+	}
+	if statusCode < 200 || statusCode > 299 {
+		packetConn.Close()
+		return nil, E.New("CONNECT-UDP failed with status ", responseHeaders[":status"])
+	}
+	return packetConn, nil
+}
+
+// connectUDPConn is a net.PacketConn bound to a single destination, carrying
+// UDP payloads in HTTP Datagram capsules with context ID 0 (RFC 9297, RFC 9298).
+type connectUDPConn struct {
+	conn        net.Conn
+	reader      *bufio.Reader
+	destination M.Socksaddr
+	client      *NaiveClient
+	readAccess  sync.Mutex
+	writeAccess sync.Mutex
+	closeOnce   sync.Once
+}
+
+func (c *connectUDPConn) release() {
+	c.closeOnce.Do(func() {
+		if c.client != nil {
+			c.client.activeConnections.Done()
+		}
+	})
+}
+
+func (c *connectUDPConn) destinationAddr() net.Addr {
+	return socksaddrToNetAddr(c.destination, N.NetworkUDP)
+}
+
+// ReadFrom reads the payload of the next DATAGRAM capsule with context ID 0.
+// Payloads larger than p are truncated, like on a UDP socket.
+func (c *connectUDPConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	c.readAccess.Lock()
+	defer c.readAccess.Unlock()
+	for {
+		var capsuleType, length, contextID uint64
+		capsuleType, _, err = readQUICVarint(c.reader)
+		if err != nil {
+			return
+		}
+		length, _, err = readQUICVarint(c.reader)
+		if err != nil {
+			return
+		}
+		if capsuleType != capsuleTypeDatagram {
+			// Unknown capsules must be skipped (RFC 9297 section 3.2).
+			_, err = io.CopyN(io.Discard, c.reader, int64(length))
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if length > maxDatagramCapsuleLength {
+			return 0, nil, E.New("DATAGRAM capsule too large: ", length)
+		}
+		var contextIDLength int
+		contextID, contextIDLength, err = readQUICVarint(c.reader)
+		if err != nil {
+			return
+		}
+		if uint64(contextIDLength) > length {
+			return 0, nil, E.New("invalid DATAGRAM capsule")
+		}
+		payloadLength := int(length) - contextIDLength
+		if contextID != 0 {
+			_, err = io.CopyN(io.Discard, c.reader, int64(payloadLength))
+			if err != nil {
+				return
+			}
+			continue
+		}
+		n = min(payloadLength, len(p))
+		_, err = io.ReadFull(c.reader, p[:n])
+		if err != nil {
+			return 0, nil, err
+		}
+		_, err = io.CopyN(io.Discard, c.reader, int64(payloadLength-n))
+		if err != nil {
+			return 0, nil, err
+		}
+		return n, c.destinationAddr(), nil
+	}
+}
+
+func (c *connectUDPConn) Read(p []byte) (n int, err error) {
+	n, _, err = c.ReadFrom(p)
+	return
+}
+
+func (c *connectUDPConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
+	if destination := M.SocksaddrFromNet(addr).Unwrap(); destination != c.destination.Unwrap() {
+		return 0, E.New("CONNECT-UDP session is bound to ", c.destination, ", cannot write to ", destination)
+	}
+	return c.Write(p)
+}
+
+func (c *connectUDPConn) Write(p []byte) (n int, err error) {
+	capsule := make([]byte, 0, 1+8+1+len(p))
+	capsule = appendQUICVarint(capsule, capsuleTypeDatagram)
+	capsule = appendQUICVarint(capsule, uint64(1+len(p)))
+	capsule = appendQUICVarint(capsule, 0)
+	capsule = append(capsule, p...)
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	_, err = c.conn.Write(capsule)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *connectUDPConn) Close() error {
+	c.release()
+	return c.conn.Close()
+}
+
+func (c *connectUDPConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *connectUDPConn) RemoteAddr() net.Addr {
+	return c.destinationAddr()
+}
+
+func (c *connectUDPConn) SetDeadline(t time.Time) error {
+	return c.conn.SetDeadline(t)
+}
+
+func (c *connectUDPConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *connectUDPConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// appendQUICVarint appends x as a QUIC variable-length integer (RFC 9000 section 16).
+func appendQUICVarint(b []byte, x uint64) []byte {
+	switch {
+	case x < 1<<6:
+		return append(b, byte(x))
+	case x < 1<<14:
+		return binary.BigEndian.AppendUint16(b, uint16(x)|0x4000)
+	case x < 1<<30:
+		return binary.BigEndian.AppendUint32(b, uint32(x)|0x80000000)
+	case x <= maxQUICVarint:
+		return binary.BigEndian.AppendUint64(b, x|0xc000000000000000)
+	default:
+		panic("QUIC varint overflow")
+	}
+}
+
+// readQUICVarint reads a QUIC variable-length integer and returns its encoded length.
+func readQUICVarint(reader io.ByteReader) (uint64, int, error) {
+	first, err := reader.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	length := 1 << (first >> 6)
+	value := uint64(first & 0x3f)
+	for i := 1; i < length; i++ {
+		next, err := reader.ReadByte()
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, 0, err
+		}
+		value = value<<8 | uint64(next)
+	}
+	return value, length, nil
+}
@@ -0,0 +1,84 @@
+package cronet
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+func TestQUICVarint(t *testing.T) {
+	t.Parallel()
+	// Examples from RFC 9000 appendix A.1.
+	for _, testCase := range []struct {
+		value   uint64
+		encoded []byte
+	}{
+		{151288809941952652, []byte{0xc2, 0x19, 0x7c, 0x5e, 0xff, 0x14, 0xe8, 0x8c}},
+		{494878333, []byte{0x9d, 0x7f, 0x3e, 0x7d}},
+		{15293, []byte{0x7b, 0xbd}},
+		{37, []byte{0x25}},
+	} {
+		if encoded := appendQUICVarint(nil, testCase.value); !bytes.Equal(encoded, testCase.encoded) {
+			t.Fatalf("encode %d: got %x, want %x", testCase.value, encoded, testCase.encoded)
+		}
+		value, length, err := readQUICVarint(bytes.NewReader(testCase.encoded))
+		if err != nil || value != testCase.value || length != len(testCase.encoded) {
+			t.Fatalf("decode %x: got %d (%d bytes), %v", testCase.encoded, value, length, err)
+		}
+	}
+	// Non-minimal two-byte encoding of 37.
+	value, length, err := readQUICVarint(bytes.NewReader([]byte{0x40, 0x25}))
+	if err != nil || value != 37 || length != 2 {
+		t.Fatalf("decode non-minimal: got %d (%d bytes), %v", value, length, err)
+	}
+}
+
+func TestExpandConnectUDPTemplate(t *testing.T) {
+	t.Parallel()
+	template := "https://proxy.example:443" + connectUDPDefaultPath
+	if expanded := expandConnectUDPTemplate(template, M.ParseSocksaddr("192.0.2.6:443")); expanded != "https://proxy.example:443/.well-known/masque/udp/192.0.2.6/443/" {
+		t.Fatalf("unexpected IPv4 expansion %q", expanded)
+	}
+	if expanded := expandConnectUDPTemplate(template, M.ParseSocksaddr("[2001:db8::42]:53")); expanded != "https://proxy.example:443/.well-known/masque/udp/2001%3Adb8%3A%3A42/53/" {
+		t.Fatalf("unexpected IPv6 expansion %q", expanded)
+	}
+}
+
+func TestConnectUDPConnCapsules(t *testing.T) {
+	t.Parallel()
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	destination := M.ParseSocksaddr("192.0.2.6:53")
+	packetConn := &connectUDPConn{conn: clientConn, reader: bufio.NewReader(clientConn), destination: destination}
+	defer packetConn.Close()
+
+	go packetConn.WriteTo([]byte("query"), destination.UDPAddr())
+	capsule := make([]byte, 8)
+	if _, err := serverConn.Read(capsule); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(capsule, []byte{0x00, 0x06, 0x00, 'q', 'u', 'e', 'r', 'y'}) {
+		t.Fatalf("unexpected capsule %x", capsule)
+	}
+	if _, err := packetConn.WriteTo([]byte("query"), M.ParseSocksaddr("192.0.2.7:53").UDPAddr()); err == nil {
+		t.Fatal("expected error writing to a different destination")
+	}
+
+	go func() {
+		// An unknown capsule, a datagram with context ID 1, then the answer.
+		serverConn.Write([]byte{0x17, 0x02, 0xaa, 0xbb})
+		serverConn.Write([]byte{0x00, 0x02, 0x01, 0xcc})
+		serverConn.Write([]byte{0x00, 0x07, 0x00, 'a', 'n', 's', 'w', 'e', 'r'})
+	}()
+	buffer := make([]byte, 4)
+	n, addr, err := packetConn.ReadFrom(buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buffer[:n]) != "answ" || M.SocksaddrFromNet(addr) != destination {
+		t.Fatalf("unexpected packet %q from %v", buffer[:n], addr)
+	}
+}
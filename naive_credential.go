@@ -0,0 +1,131 @@
+package cronet
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+// ErrProxyAuthenticationRequired is returned by the NaiveConn handshake when
+// the server rejects the proxy credential with 407.
+var ErrProxyAuthenticationRequired = errors.New("proxy authentication required")
+
+// ProxyCredential is a credential sent in the proxy-authorization header.
+type ProxyCredential struct {
+	// Username and Password produce a Basic credential.
+	Username string
+	Password string
+	// Token produces a Bearer credential and takes precedence over Username.
+	Token string
+	// ExpiresAt is when the credential must be fetched again. If zero, it is
+	// cached until the server rejects it.
+	ExpiresAt time.Time
+}
+
+func (c ProxyCredential) authorization() string {
+	if c.Token != "" {
+		return "Bearer " + c.Token
+	}
+	if c.Username != "" {
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(c.Username+":"+c.Password))
+	}
+	return ""
+}
+
+// ProxyCredentialProvider returns the credential for new connections. refresh
+// is set when the cached credential was rejected by the server, so a cached
+// token on the provider side must not be returned again.
+type ProxyCredentialProvider func(ctx context.Context, refresh bool) (ProxyCredential, error)
+
+// proxyCredentialCache caches the authorization from a ProxyCredentialProvider.
+// Concurrent dials share one provider call, which runs without the lock held
+// so a slow provider only delays the dials waiting for a credential.
+type proxyCredentialCache struct {
+	provider      ProxyCredentialProvider
+	timeNow       func() time.Time
+	access        sync.Mutex
+	authorization string
+	expiresAt     time.Time
+	loaded        bool
+	rejected      bool
+	call          *proxyCredentialCall
+}
+
+type proxyCredentialCall struct {
+	done          chan struct{}
+	authorization string
+	err           error
+}
+
+func newProxyCredentialCache(provider ProxyCredentialProvider) *proxyCredentialCache {
+	return &proxyCredentialCache{provider: provider, timeNow: time.Now}
+}
+
+// get returns the cached authorization or waits for a provider call. The
+// provider call is not canceled with ctx, as other dials may share it.
+func (c *proxyCredentialCache) get(ctx context.Context) (string, error) {
+	c.access.Lock()
+	if c.loaded && (c.expiresAt.IsZero() || c.timeNow().Before(c.expiresAt)) {
+		authorization := c.authorization
+		c.access.Unlock()
+		return authorization, nil
+	}
+	call := c.call
+	if call == nil {
+		call = &proxyCredentialCall{done: make(chan struct{})}
+		c.call = call
+		go c.fetch(context.WithoutCancel(ctx), call, c.rejected)
+	}
+	c.access.Unlock()
+	select {
+	case <-call.done:
+		return call.authorization, call.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (c *proxyCredentialCache) fetch(ctx context.Context, call *proxyCredentialCall, refresh bool) {
+	credential, err := c.provider(ctx, refresh)
+	c.access.Lock()
+	if err != nil {
+		call.err = E.Cause(err, "get proxy credential")
+	} else {
+		c.authorization = credential.authorization()
+		c.expiresAt = credential.ExpiresAt
+		c.loaded = true
+		c.rejected = false
+		call.authorization = c.authorization
+	}
+	c.call = nil
+	c.access.Unlock()
+	close(call.done)
+}
+
+// reject drops authorization from the cache if it is still the cached value,
+// so the next get asks the provider for a fresh credential.
+func (c *proxyCredentialCache) reject(authorization string) {
+	c.access.Lock()
+	defer c.access.Unlock()
+	if c.loaded && c.authorization == authorization {
+		c.loaded = false
+		c.rejected = true
+	}
+}
+
+func (c *NaiveClient) proxyAuthorization(ctx context.Context) (string, error) {
+	if c.credentialCache == nil {
+		return c.authorization, nil
+	}
+	return c.credentialCache.get(ctx)
+}
+
+func (c *NaiveClient) rejectProxyAuthorization(authorization string) {
+	if c.credentialCache != nil {
+		c.credentialCache.reject(authorization)
+	}
+}
@@ -0,0 +1,106 @@
+package cronet
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestProxyCredentialAuthorization(t *testing.T) {
+	t.Parallel()
+	if authorization := (ProxyCredential{Username: "user", Password: "pass"}).authorization(); authorization != "Basic dXNlcjpwYXNz" {
+		t.Fatalf("unexpected Basic authorization %q", authorization)
+	}
+	if authorization := (ProxyCredential{Username: "user", Token: "token"}).authorization(); authorization != "Bearer token" {
+		t.Fatalf("unexpected Bearer authorization %q", authorization)
+	}
+}
+
+func TestProxyCredentialCache(t *testing.T) {
+	t.Parallel()
+	now := time.Unix(1700000000, 0)
+	var (
+		calls        int
+		refreshFlags []bool
+	)
+	cache := newProxyCredentialCache(func(ctx context.Context, refresh bool) (ProxyCredential, error) {
+		calls++
+		refreshFlags = append(refreshFlags, refresh)
+		return ProxyCredential{Token: string(rune('a' + calls - 1)), ExpiresAt: now.Add(time.Minute)}, nil
+	})
+	cache.timeNow = func() time.Time { return now }
+	get := func() string {
+		authorization, err := cache.get(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return authorization
+	}
+
+	if authorization := get(); authorization != "Bearer a" || get() != "Bearer a" || calls != 1 {
+		t.Fatalf("expected cached credential, got %q after %d calls", authorization, calls)
+	}
+	now = now.Add(time.Minute)
+	if authorization := get(); authorization != "Bearer b" {
+		t.Fatalf("expected refresh after expiry, got %q", authorization)
+	}
+	cache.reject("Bearer a")
+	if authorization := get(); authorization != "Bearer b" {
+		t.Fatalf("rejecting a stale credential must not refresh, got %q", authorization)
+	}
+	cache.reject("Bearer b")
+	if authorization := get(); authorization != "Bearer c" {
+		t.Fatalf("expected refresh after rejection, got %q", authorization)
+	}
+	if refreshFlags[0] || refreshFlags[1] || !refreshFlags[2] {
+		t.Fatalf("unexpected refresh flags %v", refreshFlags)
+	}
+}
+
+func TestProxyCredentialCacheSharedCall(t *testing.T) {
+	t.Parallel()
+	var calls atomic.Int32
+	release := make(chan struct{})
+	cache := newProxyCredentialCache(func(ctx context.Context, refresh bool) (ProxyCredential, error) {
+		calls.Add(1)
+		<-release
+		return ProxyCredential{Token: "token"}, nil
+	})
+
+	canceledCtx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error, 1)
+	go func() {
+		_, err := cache.get(canceledCtx)
+		canceled <- err
+	}()
+	var group sync.WaitGroup
+	authorizations := make([]string, 4)
+	for i := range authorizations {
+		group.Add(1)
+		go func(i int) {
+			defer group.Done()
+			authorization, err := cache.get(context.Background())
+			if err != nil {
+				t.Error(err)
+			}
+			authorizations[i] = authorization
+		}(i)
+	}
+	cache.reject("Bearer other")
+	cancel()
+	if err := <-canceled; err != context.Canceled {
+		t.Fatalf("expected a canceled dial to return while the provider blocks, got %v", err)
+	}
+	close(release)
+	group.Wait()
+	for _, authorization := range authorizations {
+		if authorization != "Bearer token" {
+			t.Fatalf("unexpected authorization %q", authorization)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Fatalf("expected one shared provider call, got %d", calls.Load())
+	}
+}
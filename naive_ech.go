@@ -0,0 +1,105 @@
+package cronet
+
+import (
+	"bytes"
+	"context"
+	"strconv"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+
+	mDNS "github.com/miekg/dns"
+)
+
+const (
+	echRefreshMinInterval   = time.Minute
+	echRefreshMaxInterval   = 24 * time.Hour
+	echRefreshRetryInterval = 30 * time.Second
+)
+
+// loopRefreshECHConfig, enabled by NaiveClientOptions.ECHRefresh, keeps the
+// ECH config list in sync with the HTTPS record of the ECH query server name
+// until ctx is done.
+func (c *NaiveClient) loopRefreshECHConfig(ctx context.Context) {
+	retryInterval := echRefreshRetryInterval
+	for {
+		interval, err := c.refreshECHConfig(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			c.logger.WarnContext(ctx, "refresh ECH config: ", err)
+			interval = retryInterval
+			retryInterval = min(retryInterval*2, echRefreshMinInterval*10)
+		} else {
+			retryInterval = echRefreshRetryInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// refreshECHConfig queries the HTTPS record once, applies its ECH config and
+// returns when to query again.
+func (c *NaiveClient) refreshECHConfig(ctx context.Context) (time.Duration, error) {
+	request := new(mDNS.Msg)
+	request.SetQuestion(echQueryName(c.echQueryServerNameOrDefault(), c.serverAddress.Port), mDNS.TypeHTTPS)
+	response := c.dnsResolver(ctx, request)
+	if response == nil {
+		return 0, E.New("no response")
+	}
+	if response.Rcode != mDNS.RcodeSuccess {
+		return 0, E.New("query failed: ", mDNS.RcodeToString[response.Rcode])
+	}
+	echConfigList, ttl, loaded := extractECHConfigList(response)
+	if !loaded {
+		return 0, E.New("no ECH config in HTTPS record")
+	}
+	if !bytes.Equal(echConfigList, c.getECHConfigList()) {
+		err := c.UpdateECHConfigList(echConfigList)
+		if err != nil {
+			return 0, err
+		}
+		c.logger.DebugContext(ctx, "ECH config updated, length: ", len(echConfigList))
+	}
+	return min(max(time.Duration(ttl)*time.Second, echRefreshMinInterval), echRefreshMaxInterval), nil
+}
+
+func (c *NaiveClient) echQueryServerNameOrDefault() string {
+	if c.echQueryServerName != "" {
+		return c.echQueryServerName
+	}
+	return c.serverName
+}
+
+// echQueryName returns the HTTPS query name Chromium uses for a server,
+// which carries the port prefix for non-default ports (RFC 9460 section 9.1).
+func echQueryName(serverName string, port uint16) string {
+	serverName = mDNS.Fqdn(serverName)
+	if port == 0 || port == 443 {
+		return serverName
+	}
+	return "_" + strconv.Itoa(int(port)) + "._https." + serverName
+}
+
+// extractECHConfigList returns the ECH config of the first HTTPS record that
+// carries one, together with the record TTL.
+func extractECHConfigList(response *mDNS.Msg) ([]byte, uint32, bool) {
+	for _, rr := range response.Answer {
+		https, isHTTPS := rr.(*mDNS.HTTPS)
+		if !isHTTPS {
+			continue
+		}
+		for _, kv := range https.Value {
+			if echConfig, isECHConfig := kv.(*mDNS.SVCBECHConfig); isECHConfig && len(echConfig.ECH) > 0 {
+				return echConfig.ECH, https.Hdr.Ttl, true
+			}
+		}
+	}
+	return nil, 0, false
+}
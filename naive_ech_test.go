@@ -0,0 +1,33 @@
+package cronet
+
+import (
+	"bytes"
+	"testing"
+
+	mDNS "github.com/miekg/dns"
+)
+
+func TestECHQueryName(t *testing.T) {
+	t.Parallel()
+	if name := echQueryName("example.org", 443); name != "example.org." {
+		t.Fatalf("unexpected query name %q", name)
+	}
+	if name := echQueryName("example.org", 8443); name != "_8443._https.example.org." {
+		t.Fatalf("unexpected query name %q", name)
+	}
+}
+
+func TestECHConfigExtract(t *testing.T) {
+	t.Parallel()
+	request := new(mDNS.Msg)
+	request.SetQuestion("example.org.", mDNS.TypeHTTPS)
+	if _, _, loaded := extractECHConfigList(injectECHConfig(request, nil, nil, []string{"h2"})); loaded {
+		t.Fatal("expected no ECH config in record without one")
+	}
+	response := injectECHConfig(request, nil, []byte{1, 2, 3}, []string{"h2"})
+	response.Answer = append([]mDNS.RR{&mDNS.A{Hdr: mDNS.RR_Header{Name: "example.org.", Rrtype: mDNS.TypeA}}}, response.Answer...)
+	echConfigList, ttl, loaded := extractECHConfigList(response)
+	if !loaded || !bytes.Equal(echConfigList, []byte{1, 2, 3}) || ttl != 300 {
+		t.Fatalf("unexpected ECH config %x ttl %d loaded %v", echConfigList, ttl, loaded)
+	}
+}
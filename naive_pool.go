@@ -0,0 +1,490 @@
+package cronet
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+var _ N.Dialer = (*NaivePool)(nil)
+
+// NaivePoolStrategy selects the server used for a new connection.
+type NaivePoolStrategy int
+
+const (
+	// NaivePoolStrategyFailover uses the first available server in list order.
+	NaivePoolStrategyFailover NaivePoolStrategy = iota
+	// NaivePoolStrategyRoundRobin spreads connections over available servers
+	// in proportion to their weights.
+	NaivePoolStrategyRoundRobin
+	// NaivePoolStrategyLeastLatency uses the available server with the lowest
+	// measured handshake latency, preferring higher weights on ties. A server
+	// not measured within HealthCheckInterval is given the next connection as
+	// a probe, at most once per HealthCheckInterval, so unmeasured servers get
+	// a latency and slow ones can prove faster again.
+	NaivePoolStrategyLeastLatency
+)
+
+const (
+	naivePoolDefaultHealthCheckInterval = 30 * time.Second
+	naivePoolDefaultHealthCheckTimeout  = 5 * time.Second
+	naivePoolDefaultMinBackoff          = time.Second
+	naivePoolDefaultMaxBackoff          = 5 * time.Minute
+)
+
+type NaivePoolServer struct {
+	NaiveClientOptions
+	// Weight is the relative share of connections for round-robin and the
+	// tie-breaker for least-latency. Defaults to 1.
+	Weight int
+}
+
+type NaivePoolOptions struct {
+	Context  context.Context
+	Logger   logger.ContextLogger
+	Servers  []NaivePoolServer
+	Strategy NaivePoolStrategy
+	// HealthCheckDestination is dialed through every server to probe it.
+	// If invalid, servers are only checked passively by DialContext results.
+	HealthCheckDestination M.Socksaddr
+	// HealthCheckInterval defaults to 30 seconds.
+	HealthCheckInterval time.Duration
+	// HealthCheckTimeout defaults to 5 seconds.
+	HealthCheckTimeout time.Duration
+	// MinBackoff and MaxBackoff bound how long a failing server is skipped.
+	// The backoff doubles on every consecutive failure. They default to one
+	// second and five minutes.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// NaiveServerStatus is a snapshot of a server in a NaivePool.
+type NaiveServerStatus struct {
+	Index         int
+	ServerAddress M.Socksaddr
+	ServerName    string
+	Weight        int
+	Healthy       bool
+	Failures      int
+	// Latency is the smoothed handshake latency, or zero if not yet measured.
+	Latency time.Duration
+	// RetryAt is when an unhealthy server is tried again.
+	RetryAt time.Time
+}
+
+// NaivePool dials through a list of naive servers, steering new connections
+// away from failing ones.
+type NaivePool struct {
+	ctx                    context.Context
+	cancel                 context.CancelFunc
+	logger                 logger.ContextLogger
+	strategy               NaivePoolStrategy
+	servers                []*naivePoolServer
+	healthCheckDestination M.Socksaddr
+	healthCheckInterval    time.Duration
+	healthCheckTimeout     time.Duration
+	minBackoff             time.Duration
+	maxBackoff             time.Duration
+	access                 sync.Mutex
+	healthCheckDone        chan struct{}
+	timeNow                func() time.Time
+}
+
+type naivePoolServer struct {
+	index         int
+	client        *NaiveClient
+	serverAddress M.Socksaddr
+	serverName    string
+	weight        int
+	// guarded by NaivePool.access
+	failures      int
+	retryAt       time.Time
+	latency       time.Duration
+	measuredAt    time.Time
+	probedAt      time.Time
+	currentWeight int
+}
+
+func NewNaivePool(options NaivePoolOptions) (*NaivePool, error) {
+	if len(options.Servers) == 0 {
+		return nil, E.New("missing servers")
+	}
+	ctx := options.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	l := options.Logger
+	if l == nil {
+		l = logger.NOP()
+	}
+	switch options.Strategy {
+	case NaivePoolStrategyFailover, NaivePoolStrategyRoundRobin, NaivePoolStrategyLeastLatency:
+	default:
+		return nil, E.New("unknown strategy: ", int(options.Strategy))
+	}
+	pool := &NaivePool{
+		logger:                 l,
+		strategy:               options.Strategy,
+		healthCheckDestination: options.HealthCheckDestination,
+		healthCheckInterval:    options.HealthCheckInterval,
+		healthCheckTimeout:     options.HealthCheckTimeout,
+		minBackoff:             options.MinBackoff,
+		maxBackoff:             options.MaxBackoff,
+		timeNow:                time.Now,
+	}
+	if pool.healthCheckInterval <= 0 {
+		pool.healthCheckInterval = naivePoolDefaultHealthCheckInterval
+	}
+	if pool.healthCheckTimeout <= 0 {
+		pool.healthCheckTimeout = naivePoolDefaultHealthCheckTimeout
+	}
+	if pool.minBackoff <= 0 {
+		pool.minBackoff = naivePoolDefaultMinBackoff
+	}
+	if pool.maxBackoff <= 0 {
+		pool.maxBackoff = naivePoolDefaultMaxBackoff
+	}
+	pool.ctx, pool.cancel = context.WithCancel(ctx)
+	for index, server := range options.Servers {
+		if server.Weight < 0 {
+			pool.cancel()
+			return nil, E.New("invalid weight for server ", index, ": ", server.Weight)
+		}
+		weight := server.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		clientOptions := server.NaiveClientOptions
+		if clientOptions.Context == nil {
+			clientOptions.Context = pool.ctx
+		}
+		if clientOptions.Logger == nil {
+			clientOptions.Logger = l
+		}
+		client, err := NewNaiveClient(clientOptions)
+		if err != nil {
+			pool.cancel()
+			return nil, E.Cause(err, "create client for server ", index)
+		}
+		pool.servers = append(pool.servers, &naivePoolServer{
+			index:         index,
+			client:        client,
+			serverAddress: client.serverAddress,
+			serverName:    client.serverName,
+			weight:        weight,
+		})
+	}
+	return pool, nil
+}
+
+// Start starts the client of every server and the health checks.
+func (p *NaivePool) Start() error {
+	for _, server := range p.servers {
+		err := server.client.Start()
+		if err != nil {
+			p.Close()
+			return E.Cause(err, "start client for server ", server.index)
+		}
+	}
+	if p.healthCheckDestination.IsValid() {
+		p.healthCheckDone = make(chan struct{})
+		go p.loopHealthCheck()
+	}
+	return nil
+}
+
+// Close stops the health checks and closes every client, waiting for their
+// connections to be closed.
+func (p *NaivePool) Close() error {
+	p.cancel()
+	if p.healthCheckDone != nil {
+		<-p.healthCheckDone
+	}
+	var errs []error
+	for _, server := range p.servers {
+		err := server.client.Close()
+		if err != nil && !errors.Is(err, net.ErrClosed) {
+			errs = append(errs, err)
+		}
+	}
+	return E.Errors(errs...)
+}
+
+// Servers returns the status of every server in list order.
+func (p *NaivePool) Servers() []NaiveServerStatus {
+	p.access.Lock()
+	defer p.access.Unlock()
+	now := p.timeNow()
+	statuses := make([]NaiveServerStatus, 0, len(p.servers))
+	for _, server := range p.servers {
+		statuses = append(statuses, server.statusLocked(now))
+	}
+	return statuses
+}
+
+// ConnServer returns the server that conn, as returned by the pool, was
+// dialed through.
+func (p *NaivePool) ConnServer(conn net.Conn) (NaiveServerStatus, bool) {
+	poolConn, isPoolConn := conn.(*naivePoolConn)
+	if !isPoolConn || poolConn.pool != p {
+		return NaiveServerStatus{}, false
+	}
+	p.access.Lock()
+	defer p.access.Unlock()
+	return poolConn.server.statusLocked(p.timeNow()), true
+}
+
+// DialEarly dials through the selected server without waiting for the
+// handshake, so a failing server is not retried with another one.
+func (p *NaivePool) DialEarly(ctx context.Context, destination M.Socksaddr) (NaiveConn, error) {
+	server := p.selectServers()[0]
+	conn, err := server.client.DialEarly(ctx, destination)
+	if err != nil {
+		return nil, err
+	}
+	return &naivePoolConn{NaiveConn: conn, pool: p, server: server}, nil
+}
+
+// DialContext dials through the selected server and retries the remaining
+// servers in order while the handshake fails.
+func (p *NaivePool) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	var errs []error
+	for _, server := range p.selectServers() {
+		startedAt := p.timeNow()
+		conn, err := server.client.DialContext(ctx, network, destination)
+		if err == nil {
+			if N.NetworkName(network) == N.NetworkTCP {
+				p.reportSuccess(server, p.timeNow().Sub(startedAt))
+				return &naivePoolConn{NaiveConn: conn.(NaiveConn), pool: p, server: server}, nil
+			}
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		p.reportFailure(server, err)
+		errs = append(errs, E.Cause(err, "server ", server.index))
+	}
+	return nil, E.Errors(errs...)
+}
+
+func (p *NaivePool) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	var errs []error
+	for _, server := range p.selectServers() {
+		conn, err := server.client.ListenPacket(ctx, destination)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, err
+		}
+		p.reportFailure(server, err)
+		errs = append(errs, E.Cause(err, "server ", server.index))
+	}
+	return nil, E.Errors(errs...)
+}
+
+// selectServers returns all servers ordered by preference: available servers
+// by strategy, followed by servers in backoff by their retry time.
+func (p *NaivePool) selectServers() []*naivePoolServer {
+	p.access.Lock()
+	defer p.access.Unlock()
+	now := p.timeNow()
+	var available, backoff []*naivePoolServer
+	for _, server := range p.servers {
+		if server.retryAt.After(now) {
+			backoff = append(backoff, server)
+		} else {
+			available = append(available, server)
+		}
+	}
+	switch p.strategy {
+	case NaivePoolStrategyRoundRobin:
+		if len(available) > 1 {
+			selected := p.nextWeightedLocked(available)
+			ordered := make([]*naivePoolServer, 0, len(available))
+			ordered = append(ordered, selected)
+			for _, server := range available {
+				if server != selected {
+					ordered = append(ordered, server)
+				}
+			}
+			available = ordered
+		}
+	case NaivePoolStrategyLeastLatency:
+		sort.SliceStable(available, func(i, j int) bool {
+			left, right := available[i].latencyScore(), available[j].latencyScore()
+			if left != right {
+				return left < right
+			}
+			return available[i].weight > available[j].weight
+		})
+		if len(available) > 1 {
+			available = p.probeFirstLocked(available, now)
+		}
+	}
+	sort.SliceStable(backoff, func(i, j int) bool {
+		return backoff[i].retryAt.Before(backoff[j].retryAt)
+	})
+	return append(available, backoff...)
+}
+
+// probeFirstLocked moves the first server with a stale latency to the front,
+// so the next connection measures it.
+func (p *NaivePool) probeFirstLocked(servers []*naivePoolServer, now time.Time) []*naivePoolServer {
+	for index, server := range servers {
+		if server.latency != 0 && now.Sub(server.measuredAt) < p.healthCheckInterval {
+			continue
+		}
+		if !server.probedAt.IsZero() && now.Sub(server.probedAt) < p.healthCheckInterval {
+			continue
+		}
+		server.probedAt = now
+		ordered := make([]*naivePoolServer, 0, len(servers))
+		ordered = append(ordered, server)
+		ordered = append(ordered, servers[:index]...)
+		return append(ordered, servers[index+1:]...)
+	}
+	return servers
+}
+
+// nextWeightedLocked implements smooth weighted round-robin.
+func (p *NaivePool) nextWeightedLocked(servers []*naivePoolServer) *naivePoolServer {
+	var (
+		selected    *naivePoolServer
+		totalWeight int
+	)
+	for _, server := range servers {
+		server.currentWeight += server.weight
+		totalWeight += server.weight
+		if selected == nil || server.currentWeight > selected.currentWeight {
+			selected = server
+		}
+	}
+	selected.currentWeight -= totalWeight
+	return selected
+}
+
+func (p *NaivePool) reportSuccess(server *naivePoolServer, latency time.Duration) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	if server.failures > 0 {
+		p.logger.Info("naive server ", server.index, " (", server.serverAddress, ") recovered")
+	}
+	server.failures = 0
+	server.retryAt = time.Time{}
+	if server.latency == 0 {
+		server.latency = latency
+	} else {
+		server.latency = (server.latency*3 + latency) / 4
+	}
+	server.measuredAt = p.timeNow()
+}
+
+func (p *NaivePool) reportFailure(server *naivePoolServer, err error) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	server.failures++
+	backoff := p.minBackoff << min(server.failures-1, 30)
+	if backoff <= 0 || backoff > p.maxBackoff {
+		backoff = p.maxBackoff
+	}
+	server.retryAt = p.timeNow().Add(backoff)
+	p.logger.Warn("naive server ", server.index, " (", server.serverAddress, ") failed, retry in ", backoff, ": ", err)
+}
+
+func (p *NaivePool) loopHealthCheck() {
+	defer close(p.healthCheckDone)
+	ticker := time.NewTicker(p.healthCheckInterval)
+	defer ticker.Stop()
+	for {
+		p.checkHealth()
+		select {
+		case <-ticker.C:
+		case <-p.ctx.Done():
+			return
+		}
+	}
+}
+
+func (p *NaivePool) checkHealth() {
+	var group sync.WaitGroup
+	for _, server := range p.servers {
+		group.Add(1)
+		go func(server *naivePoolServer) {
+			defer group.Done()
+			ctx, cancel := context.WithTimeout(p.ctx, p.healthCheckTimeout)
+			defer cancel()
+			startedAt := p.timeNow()
+			conn, err := server.client.DialContext(ctx, N.NetworkTCP, p.healthCheckDestination)
+			if err != nil {
+				if p.ctx.Err() == nil {
+					p.reportFailure(server, err)
+				}
+				return
+			}
+			conn.Close()
+			p.reportSuccess(server, p.timeNow().Sub(startedAt))
+		}(server)
+	}
+	group.Wait()
+}
+
+func (s *naivePoolServer) latencyScore() time.Duration {
+	if s.latency == 0 {
+		return math.MaxInt64
+	}
+	return s.latency
+}
+
+func (s *naivePoolServer) statusLocked(now time.Time) NaiveServerStatus {
+	return NaiveServerStatus{
+		Index:         s.index,
+		ServerAddress: s.serverAddress,
+		ServerName:    s.serverName,
+		Weight:        s.weight,
+		Healthy:       !s.retryAt.After(now),
+		Failures:      s.failures,
+		Latency:       s.latency,
+		RetryAt:       s.retryAt,
+	}
+}
+
+type naivePoolConn struct {
+	NaiveConn
+	pool   *NaivePool
+	server *naivePoolServer
+}
+
+func (c *naivePoolConn) Flush() error {
+	return c.NaiveConn.(Flusher).Flush()
+}
+
+func (c *naivePoolConn) CloseWrite() error {
+	return c.NaiveConn.(N.WriteCloser).CloseWrite()
+}
+
+func (c *naivePoolConn) SocketAddrs() (local net.Addr, remote net.Addr, loaded bool) {
+	return c.NaiveConn.(SocketAddrsConn).SocketAddrs()
+}
+
+func (c *naivePoolConn) Upstream() any {
+	return c.NaiveConn
+}
+
+func (c *naivePoolConn) ReaderReplaceable() bool {
+	return true
+}
+
+func (c *naivePoolConn) WriterReplaceable() bool {
+	return true
+}
@@ -0,0 +1,118 @@
+package cronet
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/sagernet/sing/common/logger"
+)
+
+func newTestNaivePool(strategy NaivePoolStrategy, weights ...int) (*NaivePool, *time.Time) {
+	now := time.Unix(1700000000, 0)
+	pool := &NaivePool{
+		logger:              logger.NOP(),
+		strategy:            strategy,
+		healthCheckInterval: 30 * time.Second,
+		minBackoff:          time.Second,
+		maxBackoff:          8 * time.Second,
+		timeNow:             func() time.Time { return now },
+	}
+	for index, weight := range weights {
+		pool.servers = append(pool.servers, &naivePoolServer{index: index, weight: weight})
+	}
+	return pool, &now
+}
+
+func selectedIndexes(servers []*naivePoolServer) []int {
+	indexes := make([]int, 0, len(servers))
+	for _, server := range servers {
+		indexes = append(indexes, server.index)
+	}
+	return indexes
+}
+
+func TestNaivePoolFailoverBackoff(t *testing.T) {
+	t.Parallel()
+	pool, now := newTestNaivePool(NaivePoolStrategyFailover, 1, 1, 1)
+	if indexes := selectedIndexes(pool.selectServers()); indexes[0] != 0 {
+		t.Fatalf("expected first server, got %v", indexes)
+	}
+	pool.reportFailure(pool.servers[0], errors.New("down"))
+	pool.reportFailure(pool.servers[1], errors.New("down"))
+	pool.reportFailure(pool.servers[0], errors.New("down"))
+	// Server 0 backs off for 2s, server 1 for 1s.
+	if indexes := selectedIndexes(pool.selectServers()); indexes[0] != 2 || indexes[1] != 1 || indexes[2] != 0 {
+		t.Fatalf("unexpected order %v", indexes)
+	}
+	*now = now.Add(time.Second)
+	if indexes := selectedIndexes(pool.selectServers()); indexes[0] != 1 {
+		t.Fatalf("expected server 1 after its backoff, got %v", indexes)
+	}
+	for i := 0; i < 10; i++ {
+		pool.reportFailure(pool.servers[2], errors.New("down"))
+	}
+	if status := pool.Servers()[2]; status.Healthy || status.RetryAt.Sub(*now) != 8*time.Second {
+		t.Fatalf("expected backoff capped at 8s, got %+v", status)
+	}
+	pool.reportSuccess(pool.servers[0], 10*time.Millisecond)
+	if status := pool.Servers()[0]; !status.Healthy || status.Failures != 0 {
+		t.Fatalf("expected server 0 to recover, got %+v", status)
+	}
+}
+
+func TestNaivePoolWeightedRoundRobin(t *testing.T) {
+	t.Parallel()
+	pool, _ := newTestNaivePool(NaivePoolStrategyRoundRobin, 3, 1)
+	counts := make([]int, 2)
+	for i := 0; i < 8; i++ {
+		counts[pool.selectServers()[0].index]++
+	}
+	if counts[0] != 6 || counts[1] != 2 {
+		t.Fatalf("unexpected distribution %v", counts)
+	}
+}
+
+func TestNaivePoolLeastLatency(t *testing.T) {
+	t.Parallel()
+	pool, _ := newTestNaivePool(NaivePoolStrategyLeastLatency, 1, 1, 2)
+	pool.reportSuccess(pool.servers[0], 50*time.Millisecond)
+	pool.reportSuccess(pool.servers[1], 20*time.Millisecond)
+	if indexes := selectedIndexes(pool.selectServers()); indexes[0] != 2 {
+		t.Fatalf("expected the unmeasured server to be probed, got %v", indexes)
+	}
+	if indexes := selectedIndexes(pool.selectServers()); indexes[0] != 1 || indexes[1] != 0 || indexes[2] != 2 {
+		t.Fatalf("unexpected order %v", indexes)
+	}
+	pool.reportSuccess(pool.servers[2], 20*time.Millisecond)
+	if indexes := selectedIndexes(pool.selectServers()); indexes[0] != 2 {
+		t.Fatalf("expected the heavier server on a latency tie, got %v", indexes)
+	}
+}
+
+func TestNaivePoolLeastLatencyProbe(t *testing.T) {
+	t.Parallel()
+	pool, now := newTestNaivePool(NaivePoolStrategyLeastLatency, 1, 1)
+	pool.selectServers()
+	pool.selectServers()
+	pool.reportSuccess(pool.servers[0], 10*time.Millisecond)
+	pool.reportSuccess(pool.servers[1], 50*time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if indexes := selectedIndexes(pool.selectServers()); indexes[0] != 0 {
+			t.Fatalf("expected the fastest server while latencies are fresh, got %v", indexes)
+		}
+	}
+	*now = now.Add(30 * time.Second)
+	if indexes := selectedIndexes(pool.selectServers()); indexes[0] != 0 {
+		t.Fatalf("unexpected order %v", indexes)
+	}
+	if indexes := selectedIndexes(pool.selectServers()); indexes[0] != 1 {
+		t.Fatalf("expected the stale server to be probed, got %v", indexes)
+	}
+	for i := 0; i < 6; i++ {
+		pool.reportSuccess(pool.servers[1], time.Millisecond)
+	}
+	if indexes := selectedIndexes(pool.selectServers()); indexes[0] != 1 {
+		t.Fatalf("expected the probed server to win once faster, got %v", indexes)
+	}
+}
@@ -0,0 +1,78 @@
+package naiveserver
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/sagernet/cronet-go/internal/naive"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+// serverConn is the tunnel of one CONNECT request: the request body carries
+// the upload and the response body the download, both in naive framing.
+type serverConn struct {
+	reader     io.ReadCloser
+	writer     io.Writer
+	controller *http.ResponseController
+	padding    naive.PaddingConn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+}
+
+func newServerConn(request *http.Request, writer http.ResponseWriter, controller *http.ResponseController, paddingType naive.PaddingType, paddingPolicy *PaddingPolicy) *serverConn {
+	conn := &serverConn{
+		reader:     request.Body,
+		writer:     writer,
+		controller: controller,
+		localAddr:  localAddr(request),
+		remoteAddr: M.ParseSocksaddr(request.RemoteAddr),
+	}
+	if paddingType == naive.PaddingTypeVariant1 {
+		conn.padding = naive.NewPaddingConn(paddingPolicy)
+	}
+	return conn
+}
+
+func (c *serverConn) Read(p []byte) (n int, err error) {
+	return c.padding.Read(c.reader, p)
+}
+
+func (c *serverConn) Write(p []byte) (n int, err error) {
+	n, err = c.padding.Write(c.writer, p)
+	if err != nil {
+		return
+	}
+	return n, c.controller.Flush()
+}
+
+// Close closes the request body. The response stream is finished when the
+// handler returns.
+func (c *serverConn) Close() error {
+	return c.reader.Close()
+}
+
+func (c *serverConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *serverConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *serverConn) SetDeadline(t time.Time) error {
+	err := c.controller.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.controller.SetWriteDeadline(t)
+}
+
+func (c *serverConn) SetReadDeadline(t time.Time) error {
+	return c.controller.SetReadDeadline(t)
+}
+
+func (c *serverConn) SetWriteDeadline(t time.Time) error {
+	return c.controller.SetWriteDeadline(t)
+}
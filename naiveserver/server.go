@@ -0,0 +1,149 @@
+// Package naiveserver implements a naive proxy server as an http.Handler.
+//
+// It is pure Go and does not load Cronet, so it can be embedded into any
+// service that serves HTTP/2 or HTTP/3 with TLS.
+package naiveserver
+
+import (
+	"encoding/base64"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sagernet/cronet-go/internal/naive"
+	"github.com/sagernet/sing/common/auth"
+	"github.com/sagernet/sing/common/bufio"
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+type Options struct {
+	// Users allowed to connect. If empty, authentication is disabled.
+	Users []auth.User
+	// Dialer dials the CONNECT destination. Defaults to N.SystemDialer.
+	Dialer N.Dialer
+	Logger logger.ContextLogger
+	// PaddingPolicy shapes the padding sent to clients. Its Frames, and
+	// whether LaterSizes is set, must match the clients; sizes need not.
+	// Defaults to the naiveproxy padding.
+	PaddingPolicy *PaddingPolicy
+}
+
+// PaddingPolicy shapes the padding of naive connections.
+type PaddingPolicy = naive.PaddingPolicy
+
+// PaddingSizeBucket is a bucket of a padding size profile.
+type PaddingSizeBucket = naive.PaddingSizeBucket
+
+// Handler serves naive CONNECT requests. Requests over HTTP/1 are rejected,
+// as the naive client only speaks HTTP/2 and HTTP/3.
+type Handler struct {
+	authenticator *auth.Authenticator
+	dialer        N.Dialer
+	logger        logger.ContextLogger
+	paddingPolicy *PaddingPolicy
+}
+
+func NewHandler(options Options) (*Handler, error) {
+	paddingPolicy, err := options.PaddingPolicy.Validate()
+	if err != nil {
+		return nil, err
+	}
+	handler := &Handler{
+		authenticator: auth.NewAuthenticator(options.Users),
+		dialer:        options.Dialer,
+		logger:        options.Logger,
+		paddingPolicy: paddingPolicy,
+	}
+	if handler.dialer == nil {
+		handler.dialer = N.SystemDialer
+	}
+	if handler.logger == nil {
+		handler.logger = logger.NOP()
+	}
+	return handler, nil
+}
+
+func (h *Handler) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	ctx := request.Context()
+	if request.Method != http.MethodConnect {
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+		h.logger.DebugContext(ctx, "reject request from ", request.RemoteAddr, ": not CONNECT")
+		return
+	}
+	if request.ProtoMajor < 2 {
+		writer.WriteHeader(http.StatusHTTPVersionNotSupported)
+		h.logger.DebugContext(ctx, "reject request from ", request.RemoteAddr, ": unsupported protocol ", request.Proto)
+		return
+	}
+	if h.authenticator != nil {
+		username, password, loaded := parseBasicAuth(request.Header.Get("Proxy-Authorization"))
+		if !loaded || !h.authenticator.Verify(username, password) {
+			writer.WriteHeader(http.StatusProxyAuthRequired)
+			h.logger.DebugContext(ctx, "reject request from ", request.RemoteAddr, ": authentication failed")
+			return
+		}
+	}
+	paddingRequest := request.Header.Get("Padding-Type-Request")
+	paddingType, loaded := naive.ParsePaddingTypeRequest(paddingRequest, request.Header.Get("Padding") != "")
+	if !loaded {
+		writer.WriteHeader(http.StatusBadRequest)
+		h.logger.DebugContext(ctx, "reject request from ", request.RemoteAddr, ": unsupported padding types ", paddingRequest)
+		return
+	}
+	destination := M.ParseSocksaddr(request.Host)
+	if !destination.IsValid() || destination.Port == 0 {
+		writer.WriteHeader(http.StatusBadRequest)
+		h.logger.DebugContext(ctx, "reject request from ", request.RemoteAddr, ": invalid destination ", request.Host)
+		return
+	}
+	h.logger.InfoContext(ctx, "inbound connection from ", request.RemoteAddr, " to ", destination)
+	outbound, err := h.dialer.DialContext(ctx, N.NetworkTCP, destination)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		h.logger.ErrorContext(ctx, E.Cause(err, "dial ", destination))
+		return
+	}
+	if paddingRequest != "" {
+		writer.Header().Set("Padding-Type-Reply", strconv.Itoa(int(paddingType)))
+	}
+	if paddingType == naive.PaddingTypeVariant1 {
+		writer.Header().Set("Padding", h.paddingPolicy.GenerateHeader())
+	}
+	writer.WriteHeader(http.StatusOK)
+	controller := http.NewResponseController(writer)
+	err = controller.Flush()
+	if err != nil {
+		outbound.Close()
+		h.logger.ErrorContext(ctx, E.Cause(err, "flush response"))
+		return
+	}
+	conn := newServerConn(request, writer, controller, paddingType, h.paddingPolicy)
+	err = bufio.CopyConn(ctx, conn, outbound)
+	if err != nil && !E.IsClosedOrCanceled(err) {
+		h.logger.DebugContext(ctx, E.Cause(err, "connection to ", destination))
+	}
+}
+
+func parseBasicAuth(authorization string) (username string, password string, loaded bool) {
+	const prefix = "Basic "
+	if len(authorization) < len(prefix) || !strings.EqualFold(authorization[:len(prefix)], prefix) {
+		return
+	}
+	decoded, err := base64.StdEncoding.DecodeString(authorization[len(prefix):])
+	if err != nil {
+		return
+	}
+	username, password, loaded = strings.Cut(string(decoded), ":")
+	return
+}
+
+func localAddr(request *http.Request) net.Addr {
+	if addr, loaded := request.Context().Value(http.LocalAddrContextKey).(net.Addr); loaded {
+		return addr
+	}
+	return M.Socksaddr{}
+}
@@ -0,0 +1,149 @@
+package naiveserver
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/sagernet/cronet-go/internal/naive"
+	"github.com/sagernet/sing/common/auth"
+	E "github.com/sagernet/sing/common/exceptions"
+	M "github.com/sagernet/sing/common/metadata"
+)
+
+type echoDialer struct {
+	destinations chan M.Socksaddr
+}
+
+func (d *echoDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	d.destinations <- destination
+	serverConn, clientConn := net.Pipe()
+	go func() {
+		defer serverConn.Close()
+		io.Copy(serverConn, serverConn)
+	}()
+	return clientConn, nil
+}
+
+func (d *echoDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return nil, E.New("not implemented")
+}
+
+func startTestServer(t *testing.T) (*httptest.Server, *echoDialer) {
+	dialer := &echoDialer{destinations: make(chan M.Socksaddr, 1)}
+	handler, err := NewHandler(Options{
+		Users:  []auth.User{{Username: "user", Password: "pass"}},
+		Dialer: dialer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	return server, dialer
+}
+
+func connect(t *testing.T, server *httptest.Server, header http.Header) (*http.Response, *io.PipeWriter) {
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bodyReader, bodyWriter := io.Pipe()
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    serverURL,
+		Host:   "example.com:443",
+		Header: header,
+		Body:   bodyReader,
+	}
+	response, err := server.Client().Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		bodyWriter.Close()
+		response.Body.Close()
+	})
+	return response, bodyWriter
+}
+
+func TestServerPadding(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		name          string
+		paddingHeader string
+		requestHeader string
+		replyHeader   string
+		frames        int
+	}{
+		{name: "negotiated variant1", paddingHeader: "padding", requestHeader: naive.PaddingTypeRequest, replyHeader: "1", frames: naive.PaddingCount},
+		{name: "negotiated none", paddingHeader: "padding", requestHeader: "0", replyHeader: "0"},
+		{name: "legacy", paddingHeader: "padding", frames: naive.PaddingCount},
+		{name: "no padding"},
+	} {
+		t.Run(testCase.name, func(t *testing.T) {
+			t.Parallel()
+			server, dialer := startTestServer(t)
+			header := http.Header{"Proxy-Authorization": {"Basic dXNlcjpwYXNz"}}
+			if testCase.paddingHeader != "" {
+				header.Set("Padding", testCase.paddingHeader)
+			}
+			if testCase.requestHeader != "" {
+				header.Set("Padding-Type-Request", testCase.requestHeader)
+			}
+			response, bodyWriter := connect(t, server, header)
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("unexpected status %s", response.Status)
+			}
+			if reply := response.Header.Get("Padding-Type-Reply"); reply != testCase.replyHeader {
+				t.Fatalf("unexpected padding type reply %q", reply)
+			}
+			if (response.Header.Get("Padding") != "") != (testCase.frames > 0) {
+				t.Fatalf("unexpected padding header %q", response.Header.Get("Padding"))
+			}
+			if destination := <-dialer.destinations; destination.String() != "example.com:443" {
+				t.Fatalf("unexpected destination %s", destination)
+			}
+			var clientPadding naive.PaddingConn
+			if testCase.frames > 0 {
+				clientPadding = naive.NewPaddingConn(nil)
+			}
+			buffer := make([]byte, 64)
+			for _, message := range []string{"hello", "naive", "server"} {
+				_, err := clientPadding.Write(bodyWriter, []byte(message))
+				if err != nil {
+					t.Fatal(err)
+				}
+				var received []byte
+				for len(received) < len(message) {
+					n, err := clientPadding.Read(response.Body, buffer)
+					if err != nil {
+						t.Fatal(err)
+					}
+					received = append(received, buffer[:n]...)
+				}
+				if string(received) != message {
+					t.Fatalf("expected %q, got %q", message, received)
+				}
+			}
+		})
+	}
+}
+
+func TestServerRejectsUnauthorized(t *testing.T) {
+	t.Parallel()
+	server, _ := startTestServer(t)
+	response, _ := connect(t, server, http.Header{
+		"Proxy-Authorization": {"Basic dXNlcjp3cm9uZw=="},
+		"Padding":             {"padding"},
+	})
+	if response.StatusCode != http.StatusProxyAuthRequired {
+		t.Fatalf("unexpected status %s", response.Status)
+	}
+}
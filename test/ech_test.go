@@ -12,6 +12,7 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	cronet "github.com/sagernet/cronet-go"
 	M "github.com/sagernet/sing/common/metadata"
@@ -248,3 +249,40 @@ func marshalECHConfig(id uint8, pubKey []byte, publicName string, maxNameLen uin
 	})
 	return builder.Bytes()
 }
+
+// TestNaiveECHRefresh verifies that ECHRefresh queries the HTTPS record in the
+// background and that UpdateECHConfigList requires ECH.
+func TestNaiveECHRefresh(t *testing.T) {
+	env := setupTestEnv(t)
+
+	echConfigPEM, _, err := echKeygenDefault("not.example.org")
+	require.NoError(t, err)
+	echConfigBlock, _ := pem.Decode([]byte(echConfigPEM))
+	require.NotNil(t, echConfigBlock)
+
+	httpsQueries := make(chan string, 16)
+	localResolver := localhostDNSResolver(t)
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		DNSResolver: func(ctx context.Context, request *mDNS.Msg) *mDNS.Msg {
+			if len(request.Question) > 0 && request.Question[0].Qtype == mDNS.TypeHTTPS {
+				select {
+				case httpsQueries <- request.Question[0].Name:
+				default:
+				}
+			}
+			return localResolver(ctx, request)
+		},
+		ECHEnabled: true,
+		ECHRefresh: true,
+	})
+	select {
+	case name := <-httpsQueries:
+		require.Equal(t, fmt.Sprintf("_%d._https.example.org.", naiveServerPort), name)
+	case <-time.After(5 * time.Second):
+		t.Fatal("ECH refresher did not query the HTTPS record")
+	}
+	require.NoError(t, client.UpdateECHConfigList(echConfigBlock.Bytes))
+
+	plainClient := env.newNaiveClient(t, cronet.NaiveClientOptions{})
+	require.Error(t, plainClient.UpdateECHConfigList(echConfigBlock.Bytes))
+}
@@ -0,0 +1,245 @@
+package test
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	cronet "github.com/sagernet/cronet-go"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// extendedConnectHandler serves the streams of startExtendedConnectServer.
+type extendedConnectHandler struct {
+	responseFields []hpack.HeaderField
+	// consume handles the complete messages at the start of pending, writes
+	// replies with write and returns the unconsumed rest.
+	consume func(pending []byte, write func([]byte)) []byte
+}
+
+// startExtendedConnectServer starts a minimal HTTP/2 server advertising
+// SETTINGS_ENABLE_CONNECT_PROTOCOL (RFC 8441), as net/http only enables
+// extended CONNECT with GODEBUG=http2xconnect=1 at startup. It reports the
+// request headers of each stream and answers with :status 200.
+func startExtendedConnectServer(t *testing.T, certificate tls.Certificate, requestHeaders chan<- map[string]string, handler extendedConnectHandler) uint16 {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		NextProtos:   []string{"h2"},
+	})
+	require.NoError(t, err)
+	var (
+		connAccess sync.Mutex
+		conns      []net.Conn
+	)
+	t.Cleanup(func() {
+		listener.Close()
+		connAccess.Lock()
+		defer connAccess.Unlock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+	})
+	go func() {
+		for {
+			conn, acceptErr := listener.Accept()
+			if acceptErr != nil {
+				return
+			}
+			connAccess.Lock()
+			conns = append(conns, conn)
+			connAccess.Unlock()
+			go serveExtendedConnect(conn, requestHeaders, handler)
+		}
+	}()
+	return uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func serveExtendedConnect(conn net.Conn, requestHeaders chan<- map[string]string, handler extendedConnectHandler) {
+	defer conn.Close()
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil || string(preface) != http2.ClientPreface {
+		return
+	}
+	framer := http2.NewFramer(conn, conn)
+	framer.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	if err := framer.WriteSettings(http2.Setting{ID: http2.SettingEnableConnectProtocol, Val: 1}); err != nil {
+		return
+	}
+	var headerBuffer bytes.Buffer
+	encoder := hpack.NewEncoder(&headerBuffer)
+	pending := make(map[uint32][]byte)
+	for {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch frame := frame.(type) {
+		case *http2.SettingsFrame:
+			if !frame.IsAck() {
+				framer.WriteSettingsAck()
+			}
+		case *http2.PingFrame:
+			if !frame.IsAck() {
+				framer.WritePing(true, frame.Data)
+			}
+		case *http2.MetaHeadersFrame:
+			headers := make(map[string]string)
+			for _, field := range frame.Fields {
+				headers[field.Name] = field.Value
+			}
+			select {
+			case requestHeaders <- headers:
+			default:
+			}
+			headerBuffer.Reset()
+			encoder.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+			for _, field := range handler.responseFields {
+				encoder.WriteField(field)
+			}
+			framer.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      frame.StreamID,
+				BlockFragment: headerBuffer.Bytes(),
+				EndHeaders:    true,
+			})
+		case *http2.DataFrame:
+			data := frame.Data()
+			if len(data) > 0 {
+				framer.WriteWindowUpdate(0, uint32(len(data)))
+				framer.WriteWindowUpdate(frame.StreamID, uint32(len(data)))
+			}
+			streamID := frame.StreamID
+			pending[streamID] = handler.consume(append(pending[streamID], data...), func(reply []byte) {
+				framer.WriteData(streamID, false, reply)
+			})
+		}
+	}
+}
+
+func TestNaiveConnectUDP(t *testing.T) {
+	caPem, certPem, keyPem := generateCertificate(t, "example.org")
+	caPemContent, err := os.ReadFile(caPem)
+	require.NoError(t, err)
+	certificate, err := tls.LoadX509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+	env := &testEnv{caPEM: caPemContent, certPath: certPem, keyPath: keyPem}
+
+	echoAddress := startUDPEchoServer(t)
+	targetConn, err := net.Dial("udp", echoAddress.String())
+	require.NoError(t, err)
+	t.Cleanup(func() { targetConn.Close() })
+	requestHeaders := make(chan map[string]string, 1)
+	serverPort := startExtendedConnectServer(t, certificate, requestHeaders, extendedConnectHandler{
+		responseFields: []hpack.HeaderField{{Name: "capsule-protocol", Value: "?1"}},
+		consume:        forwardDatagramCapsules(targetConn),
+	})
+
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		ServerAddress: M.ParseSocksaddrHostPort("127.0.0.1", serverPort),
+		ConnectUDP:    true,
+	})
+	conn, err := client.DialContext(context.Background(), N.NetworkUDP, echoAddress)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+	headers := <-requestHeaders
+	require.Equal(t, "CONNECT", headers[":method"])
+	require.Equal(t, "connect-udp", headers[":protocol"])
+	require.Equal(t, "https", headers[":scheme"])
+	require.Equal(t, fmt.Sprintf("/.well-known/masque/udp/127.0.0.1/%d/", echoAddress.Port), headers[":path"])
+	require.Equal(t, "?1", headers["capsule-protocol"])
+	require.Equal(t, "Basic dGVzdDp0ZXN0", headers["proxy-authorization"])
+
+	for _, message := range []string{"first", "second"} {
+		_, err = conn.Write([]byte(message))
+		require.NoError(t, err)
+		buffer := make([]byte, 1024)
+		n, err := conn.Read(buffer)
+		require.NoError(t, err)
+		require.Equal(t, message, string(buffer[:n]))
+	}
+}
+
+// forwardDatagramCapsules relays the payloads of DATAGRAM capsules with
+// context ID 0 (RFC 9298 section 5) to target and wraps each reply the same
+// way.
+func forwardDatagramCapsules(target net.Conn) func(pending []byte, write func([]byte)) []byte {
+	return func(pending []byte, write func([]byte)) []byte {
+		for {
+			capsuleType, typeLength := readQUICVarint(pending)
+			if typeLength == 0 {
+				return pending
+			}
+			capsuleLength, lengthLength := readQUICVarint(pending[typeLength:])
+			headerLength := typeLength + lengthLength
+			if lengthLength == 0 || uint64(len(pending)-headerLength) < capsuleLength {
+				return pending
+			}
+			capsule := pending[headerLength : headerLength+int(capsuleLength)]
+			pending = pending[headerLength+int(capsuleLength):]
+			if capsuleType != 0 {
+				continue
+			}
+			contextID, contextLength := readQUICVarint(capsule)
+			if contextLength == 0 || contextID != 0 {
+				continue
+			}
+			if _, err := target.Write(capsule[contextLength:]); err != nil {
+				continue
+			}
+			reply := make([]byte, 65535)
+			target.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, err := target.Read(reply)
+			if err != nil {
+				continue
+			}
+			response := appendQUICVarint(nil, 0)
+			response = appendQUICVarint(response, uint64(1+n))
+			response = append(response, 0)
+			write(append(response, reply[:n]...))
+		}
+	}
+}
+
+// readQUICVarint decodes a QUIC variable-length integer (RFC 9000 section
+// 16) and returns its length, or 0 if b is too short.
+func readQUICVarint(b []byte) (uint64, int) {
+	if len(b) == 0 {
+		return 0, 0
+	}
+	length := 1 << (b[0] >> 6)
+	if len(b) < length {
+		return 0, 0
+	}
+	value := uint64(b[0] & 0x3f)
+	for _, octet := range b[1:length] {
+		value = value<<8 | uint64(octet)
+	}
+	return value, length
+}
+
+func appendQUICVarint(b []byte, value uint64) []byte {
+	switch {
+	case value < 1<<6:
+		return append(b, byte(value))
+	case value < 1<<14:
+		return append(b, byte(value>>8)|0x40, byte(value))
+	case value < 1<<30:
+		return append(b, byte(value>>24)|0x80, byte(value>>16), byte(value>>8), byte(value))
+	default:
+		return append(b, byte(value>>56)|0xc0, byte(value>>48), byte(value>>40), byte(value>>32),
+			byte(value>>24), byte(value>>16), byte(value>>8), byte(value))
+	}
+}
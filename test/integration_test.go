@@ -22,6 +22,7 @@ import (
 	N "github.com/sagernet/sing/common/network"
 
 	mDNS "github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -1026,3 +1027,415 @@ func TestCloseAllConnectionsThenClientClose(t *testing.T) {
 		t.Fatal("client.Close() timed out after Engine().CloseAllConnections()")
 	}
 }
+
+func startUDPEchoServer(t *testing.T) M.Socksaddr {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buffer := make([]byte, 65535)
+		for {
+			n, addr, err := conn.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			conn.WriteTo(buffer[:n], addr)
+		}
+	}()
+	return M.SocksaddrFromNet(conn.LocalAddr())
+}
+
+func TestNaiveUDPOverTCP(t *testing.T) {
+	env := setupTestEnv(t)
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{})
+	echoAddress := startUDPEchoServer(t)
+
+	t.Run("ListenPacket", func(t *testing.T) {
+		packetConn, err := client.ListenPacket(context.Background(), echoAddress)
+		require.NoError(t, err)
+		defer packetConn.Close()
+		require.NoError(t, packetConn.SetDeadline(time.Now().Add(10*time.Second)))
+
+		_, err = packetConn.WriteTo([]byte("hello"), echoAddress.UDPAddr())
+		require.NoError(t, err)
+		buffer := make([]byte, 1024)
+		n, addr, err := packetConn.ReadFrom(buffer)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(buffer[:n]))
+		require.Equal(t, echoAddress, M.SocksaddrFromNet(addr).Unwrap())
+	})
+
+	t.Run("DialContext", func(t *testing.T) {
+		conn, err := client.DialContext(context.Background(), N.NetworkUDP, echoAddress)
+		require.NoError(t, err)
+		defer conn.Close()
+		require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+
+		for _, message := range []string{"first", "second"} {
+			_, err = conn.Write([]byte(message))
+			require.NoError(t, err)
+			buffer := make([]byte, 1024)
+			n, err := conn.Read(buffer)
+			require.NoError(t, err)
+			require.Equal(t, message, string(buffer[:n]))
+		}
+	})
+}
+
+func TestNaivePoolFailover(t *testing.T) {
+	env := setupTestEnv(t)
+	startEchoServer(t, 15010)
+
+	serverOptions := func(port uint16) cronet.NaiveClientOptions {
+		return cronet.NaiveClientOptions{
+			ServerAddress:           M.ParseSocksaddrHostPort("127.0.0.1", port),
+			ServerName:              "example.org",
+			Username:                "test",
+			Password:                "test",
+			TrustedRootCertificates: string(env.caPEM),
+			DNSResolver:             localhostDNSResolver(t),
+		}
+	}
+	pool, err := cronet.NewNaivePool(cronet.NaivePoolOptions{
+		Servers: []cronet.NaivePoolServer{
+			{NaiveClientOptions: serverOptions(reserveTCPPort(t))},
+			{NaiveClientOptions: serverOptions(naiveServerPort)},
+		},
+		Strategy: cronet.NaivePoolStrategyFailover,
+	})
+	require.NoError(t, err)
+	require.NoError(t, pool.Start())
+	defer pool.Close()
+
+	conn, err := pool.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddrHostPort("127.0.0.1", 15010))
+	require.NoError(t, err)
+	defer conn.Close()
+	server, loaded := pool.ConnServer(conn)
+	require.True(t, loaded)
+	require.Equal(t, 1, server.Index)
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buffer := make([]byte, 4)
+	_, err = io.ReadFull(conn, buffer)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buffer))
+
+	statuses := pool.Servers()
+	require.False(t, statuses[0].Healthy)
+	require.True(t, statuses[1].Healthy)
+	require.NotZero(t, statuses[1].Latency)
+}
+
+func TestNaiveCredentialProviderRetry(t *testing.T) {
+	env := setupTestEnv(t)
+	startEchoServer(t, 15011)
+
+	var refreshes atomic.Int32
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		CredentialProvider: func(ctx context.Context, refresh bool) (cronet.ProxyCredential, error) {
+			if !refresh {
+				return cronet.ProxyCredential{Username: "test", Password: "stale"}, nil
+			}
+			refreshes.Add(1)
+			return cronet.ProxyCredential{Username: "test", Password: "test"}, nil
+		},
+	})
+
+	conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddrHostPort("127.0.0.1", 15011))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, int32(1), refreshes.Load())
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buffer := make([]byte, 4)
+	_, err = io.ReadFull(conn, buffer)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buffer))
+}
+
+func TestNaiveEmbeddedServer(t *testing.T) {
+	env, serverPort := setupEmbeddedTestEnv(t)
+	startEchoServer(t, 15012)
+
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		ServerAddress: M.ParseSocksaddrHostPort("127.0.0.1", serverPort),
+	})
+
+	conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddrHostPort("127.0.0.1", 15012))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	testData := make([]byte, 256*1024)
+	_, err = rand.Read(testData)
+	require.NoError(t, err)
+	go conn.Write(testData)
+	received := make([]byte, len(testData))
+	_, err = io.ReadFull(conn, received)
+	require.NoError(t, err)
+	require.Equal(t, testData, received)
+}
+
+func TestNaiveEmbeddedServerConcurrency(t *testing.T) {
+	env, serverPort := setupEmbeddedTestEnv(t)
+	startEchoServer(t, 15017)
+
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		ServerAddress: M.ParseSocksaddrHostPort("127.0.0.1", serverPort),
+	})
+
+	var group sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddrHostPort("127.0.0.1", 15017))
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer conn.Close()
+			testData := make([]byte, 64*1024)
+			rand.Read(testData)
+			go conn.Write(testData)
+			received := make([]byte, len(testData))
+			_, err = io.ReadFull(conn, received)
+			assert.NoError(t, err)
+			assert.Equal(t, testData, received)
+		}()
+	}
+	group.Wait()
+}
+
+func TestNaiveEmbeddedServerIPv6(t *testing.T) {
+	listener, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback unavailable: ", err)
+	}
+	listener.Close()
+
+	env, serverPort := setupEmbeddedTestEnv(t)
+	startEchoServer(t, 15018)
+
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		ServerAddress: M.ParseSocksaddrHostPort("::1", serverPort),
+	})
+
+	conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddrHostPort("127.0.0.1", 15018))
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buffer := make([]byte, 4)
+	_, err = io.ReadFull(conn, buffer)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buffer))
+}
+
+func TestNaiveEmbeddedServerAuthRejected(t *testing.T) {
+	env, serverPort := setupEmbeddedTestEnv(t)
+	startEchoServer(t, 15019)
+
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		ServerAddress: M.ParseSocksaddrHostPort("127.0.0.1", serverPort),
+		Password:      "wrong",
+	})
+
+	_, err := client.DialContext(context.Background(), N.NetworkTCP, M.ParseSocksaddrHostPort("127.0.0.1", 15019))
+	require.ErrorIs(t, err, cronet.ErrProxyAuthenticationRequired)
+}
+
+func TestNaiveConnAddrs(t *testing.T) {
+	env := setupTestEnv(t)
+	startEchoServer(t, 15013)
+
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{})
+
+	destination := M.ParseSocksaddrHostPort("127.0.0.1", 15013)
+	conn, err := client.DialEarly(context.Background(), destination)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	require.Equal(t, destination.TCPAddr().String(), conn.RemoteAddr().String())
+	require.NotNil(t, conn.LocalAddr())
+	require.Equal(t, conn.LocalAddr().String(), conn.LocalAddr().String())
+
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buffer := make([]byte, 4)
+	_, err = io.ReadFull(conn, buffer)
+	require.NoError(t, err)
+
+	local, remote, loaded := conn.(cronet.SocketAddrsConn).SocketAddrs()
+	require.True(t, loaded)
+	require.NotNil(t, local)
+	require.Equal(t, uint16(naiveServerPort), M.SocksaddrFromNet(remote).Port)
+
+	// A second stream reuses the session, so its socket is not known.
+	reused, err := client.DialEarly(context.Background(), destination)
+	require.NoError(t, err)
+	defer reused.Close()
+	_, err = reused.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(reused, buffer)
+	require.NoError(t, err)
+	_, _, loaded = reused.(cronet.SocketAddrsConn).SocketAddrs()
+	require.False(t, loaded)
+}
+
+func TestNaiveCloseWrite(t *testing.T) {
+	env, serverPort := setupEmbeddedTestEnv(t)
+	startEchoServer(t, 15014)
+
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		ServerAddress: M.ParseSocksaddrHostPort("127.0.0.1", serverPort),
+	})
+
+	conn, err := client.DialEarly(context.Background(), M.ParseSocksaddrHostPort("127.0.0.1", 15014))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("half-close"))
+	require.NoError(t, err)
+	require.NoError(t, conn.(N.WriteCloser).CloseWrite())
+	_, err = conn.Write([]byte("after"))
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	// The echo server only closes after reading EOF, so ReadAll returning
+	// proves END_STREAM reached it while the download stayed open.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	received, err := io.ReadAll(conn)
+	require.NoError(t, err)
+	require.Equal(t, "half-close", string(received))
+}
+
+func TestNaiveWriteBatching(t *testing.T) {
+	env, serverPort := setupEmbeddedTestEnv(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	received := make(chan []byte, 16)
+	go func() {
+		conn, acceptErr := listener.Accept()
+		if acceptErr != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			buffer := make([]byte, 4096)
+			n, readErr := conn.Read(buffer)
+			if readErr != nil {
+				close(received)
+				return
+			}
+			received <- buffer[:n]
+		}
+	}()
+
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		ServerAddress: M.ParseSocksaddrHostPort("127.0.0.1", serverPort),
+		WriteBatching: &cronet.WriteBatchOptions{
+			FlushSize:  1024 * 1024,
+			FlushDelay: time.Hour,
+		},
+	})
+
+	conn, err := client.DialContext(context.Background(), N.NetworkTCP, M.SocksaddrFromNet(listener.Addr()))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	var expected bytes.Buffer
+	for i := 0; i < 100; i++ {
+		message := fmt.Sprintf("packet %d;", i)
+		expected.WriteString(message)
+		_, err = conn.Write([]byte(message))
+		require.NoError(t, err)
+	}
+
+	// Nothing is sent before the flush, as neither threshold is reached.
+	select {
+	case data := <-received:
+		t.Fatalf("received %q before flush", data)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	require.NoError(t, conn.(cronet.Flusher).Flush())
+	var actual bytes.Buffer
+	timeout := time.After(5 * time.Second)
+	for actual.Len() < expected.Len() {
+		select {
+		case data := <-received:
+			actual.Write(data)
+		case <-timeout:
+			t.Fatalf("received %d of %d bytes after flush", actual.Len(), expected.Len())
+		}
+	}
+	require.Equal(t, expected.String(), actual.String())
+}
+
+func TestNaiveEarlyData(t *testing.T) {
+	env, serverPort := setupEmbeddedTestEnv(t)
+	startEchoServer(t, 15015)
+
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		ServerAddress: M.ParseSocksaddrHostPort("127.0.0.1", serverPort),
+		EarlyData:     true,
+	})
+
+	conn, err := client.DialEarly(context.Background(), M.ParseSocksaddrHostPort("127.0.0.1", 15015))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// The first write goes out with the CONNECT headers; the response is
+	// only checked by the read.
+	_, err = conn.Write([]byte("early"))
+	require.NoError(t, err)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buffer := make([]byte, 5)
+	_, err = io.ReadFull(conn, buffer)
+	require.NoError(t, err)
+	require.Equal(t, "early", string(buffer))
+
+	_, err = conn.Write([]byte("later"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, buffer)
+	require.NoError(t, err)
+	require.Equal(t, "later", string(buffer))
+}
+
+func TestNaiveCredentialRejectedOnRead(t *testing.T) {
+	env, serverPort := setupEmbeddedTestEnv(t)
+	startEchoServer(t, 15016)
+
+	var refreshes atomic.Int32
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		ServerAddress: M.ParseSocksaddrHostPort("127.0.0.1", serverPort),
+		CredentialProvider: func(ctx context.Context, refresh bool) (cronet.ProxyCredential, error) {
+			if !refresh {
+				return cronet.ProxyCredential{Username: "test", Password: "stale"}, nil
+			}
+			refreshes.Add(1)
+			return cronet.ProxyCredential{Username: "test", Password: "test"}, nil
+		},
+	})
+	destination := M.ParseSocksaddrHostPort("127.0.0.1", 15016)
+
+	// A connection read without Handshake sees the 407 on its first read.
+	conn, err := client.DialEarly(context.Background(), destination)
+	require.NoError(t, err)
+	_, err = conn.Read(make([]byte, 1))
+	require.ErrorIs(t, err, cronet.ErrProxyAuthenticationRequired)
+	conn.Close()
+
+	conn, err = client.DialEarly(context.Background(), destination)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, int32(1), refreshes.Load())
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buffer := make([]byte, 4)
+	_, err = io.ReadFull(conn, buffer)
+	require.NoError(t, err)
+	require.Equal(t, "ping", string(buffer))
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
@@ -28,6 +29,8 @@ import (
 	"time"
 
 	cronet "github.com/sagernet/cronet-go"
+	"github.com/sagernet/cronet-go/naiveserver"
+	"github.com/sagernet/sing/common/auth"
 	"github.com/sagernet/sing/common/bufio"
 	M "github.com/sagernet/sing/common/metadata"
 	N "github.com/sagernet/sing/common/network"
@@ -413,6 +416,36 @@ func startNaiveServer(t *testing.T, certPem, keyPem string) {
 	startNaiveServerWithConfig(t, binary, configPath, naiveServerPort, "tcp")
 }
 
+// setupEmbeddedTestEnv is like setupTestEnv, but serves naive with the
+// in-process naiveserver handler instead of sing-box, so it works offline.
+func setupEmbeddedTestEnv(t *testing.T) (*testEnv, uint16) {
+	caPem, certPem, keyPem := generateCertificate(t, "example.org")
+	caPemContent, err := os.ReadFile(caPem)
+	require.NoError(t, err)
+	certificate, err := tls.LoadX509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", ":0")
+	require.NoError(t, err)
+	handler, err := naiveserver.NewHandler(naiveserver.Options{
+		Users: []auth.User{{Username: "test", Password: "test"}},
+	})
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			NextProtos:   []string{"h2"},
+		},
+	}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+	return &testEnv{
+		caPEM:    caPemContent,
+		certPath: certPem,
+		keyPath:  keyPem,
+	}, uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
 func startNaiveServerWithConfig(t *testing.T, binary, configPath string, listenPort uint16, network string) {
 	cmd := exec.Command(binary, "run", "-c", configPath)
 	traceFile, tracePath := createArtifactTempFile(t, "trace", "sing-box-*.log")
@@ -0,0 +1,101 @@
+package test
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+
+	cronet "github.com/sagernet/cronet-go"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/stretchr/testify/require"
+)
+
+// startPaddingReplyServer serves CONNECT requests with the given
+// Padding-Type-Reply and echoes the tunnel without any padding framing.
+func startPaddingReplyServer(t *testing.T, reply string) (*testEnv, uint16) {
+	caPem, certPem, keyPem := generateCertificate(t, "example.org")
+	caPemContent, err := os.ReadFile(caPem)
+	require.NoError(t, err)
+	certificate, err := tls.LoadX509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+			writer.Header().Set("Padding-Type-Reply", reply)
+			writer.WriteHeader(http.StatusOK)
+			controller := http.NewResponseController(writer)
+			controller.Flush()
+			buffer := make([]byte, 4096)
+			for {
+				n, readErr := request.Body.Read(buffer)
+				if n > 0 {
+					writer.Write(buffer[:n])
+					controller.Flush()
+				}
+				if readErr != nil {
+					return
+				}
+			}
+		}),
+		TLSConfig: &tls.Config{
+			Certificates: []tls.Certificate{certificate},
+			NextProtos:   []string{"h2"},
+		},
+	}
+	go server.ServeTLS(listener, "", "")
+	t.Cleanup(func() { server.Close() })
+	return &testEnv{
+		caPEM:    caPemContent,
+		certPath: certPem,
+		keyPath:  keyPem,
+	}, uint16(listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestNaivePaddingNegotiatedNone(t *testing.T) {
+	env, serverPort := startPaddingReplyServer(t, "0")
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		ServerAddress: M.ParseSocksaddrHostPort("127.0.0.1", serverPort),
+	})
+
+	conn, err := client.DialEarly(context.Background(), M.ParseSocksaddrHostPort("127.0.0.1", 443))
+	require.NoError(t, err)
+	defer conn.Close()
+	// Until the reply arrives, buffers are allocated for padded frames.
+	require.Equal(t, 3, N.CalculateFrontHeadroom(conn))
+	require.Equal(t, 255, N.CalculateRearHeadroom(conn))
+
+	_, err = conn.Write([]byte("hello"))
+	require.NoError(t, err)
+	buffer := make([]byte, 5)
+	_, err = io.ReadFull(conn, buffer)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(buffer))
+	require.Zero(t, N.CalculateFrontHeadroom(conn))
+	require.Zero(t, N.CalculateRearHeadroom(conn))
+}
+
+func TestNaivePaddingUnknownReply(t *testing.T) {
+	env, serverPort := startPaddingReplyServer(t, "2")
+	client := env.newNaiveClient(t, cronet.NaiveClientOptions{
+		ServerAddress: M.ParseSocksaddrHostPort("127.0.0.1", serverPort),
+	})
+	destination := M.ParseSocksaddrHostPort("127.0.0.1", 443)
+
+	_, err := client.DialContext(context.Background(), N.NetworkTCP, destination)
+	require.ErrorContains(t, err, "unsupported padding type reply")
+
+	conn, err := client.DialEarly(context.Background(), destination)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("hello"))
+	require.ErrorContains(t, err, "unsupported padding type reply")
+	_, err = conn.Read(make([]byte, 5))
+	require.ErrorContains(t, err, "unsupported padding type reply")
+}
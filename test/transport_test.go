@@ -0,0 +1,524 @@
+package test
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	cronet "github.com/sagernet/cronet-go"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startHTTPSServer starts an HTTP/2 capable TLS server for example.org and
+// returns a started engine that trusts it and resolves example.org to loopback.
+func startHTTPSServer(t *testing.T, handler http.Handler) (cronet.Engine, string) {
+	t.Helper()
+	caPem, certPem, keyPem := generateCertificate(t, "example.org")
+	caPemContent, err := os.ReadFile(caPem)
+	require.NoError(t, err)
+	certificate, err := tls.LoadX509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+
+	engine := cronet.NewEngine()
+	require.True(t, engine.SetTrustedRootCertificates(string(caPemContent)))
+	params := cronet.NewEngineParams()
+	params.SetEnableHTTP2(true)
+	require.NoError(t, params.SetHostResolverRules("MAP example.org 127.0.0.1"))
+	require.Equal(t, cronet.ResultSuccess, engine.StartWithParams(params))
+	params.Destroy()
+	t.Cleanup(func() {
+		engine.Shutdown()
+		engine.Destroy()
+	})
+
+	return engine, fmt.Sprintf("https://example.org:%d", server.Listener.Addr().(*net.TCPAddr).Port)
+}
+
+func TestBidirectionalRoundTripperFullDuplex(t *testing.T) {
+	engine, baseURL := startHTTPSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "Grpc-Status")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			fmt.Fprintln(w, "echo:", scanner.Text())
+			w.(http.Flusher).Flush()
+		}
+		w.Header().Set("Grpc-Status", "0")
+	}))
+
+	requestReader, requestWriter := io.Pipe()
+	request, err := http.NewRequest(http.MethodPost, baseURL+"/stream", requestReader)
+	require.NoError(t, err)
+
+	transport := &cronet.BidirectionalRoundTripper{Engine: engine}
+	response, err := transport.RoundTrip(request)
+	require.NoError(t, err)
+	defer response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, 2, response.ProtoMajor)
+
+	reader := bufio.NewReader(response.Body)
+	for _, message := range []string{"first", "second"} {
+		_, err = fmt.Fprintln(requestWriter, message)
+		require.NoError(t, err)
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "echo: "+message+"\n", line)
+	}
+	require.NoError(t, requestWriter.Close())
+
+	_, err = io.Copy(io.Discard, reader)
+	require.NoError(t, err)
+	require.Equal(t, "0", response.Trailer.Get("Grpc-Status"))
+}
+
+func TestRoundTripperResponseMapping(t *testing.T) {
+	engine, baseURL := startHTTPSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/final", http.StatusFound)
+			return
+		}
+		w.Header().Add("Set-Cookie", "a=1")
+		w.Header().Add("Set-Cookie", "b=2")
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello")
+	}))
+
+	client := &http.Client{Transport: &cronet.RoundTripper{Engine: engine}}
+	response, err := client.Get(baseURL + "/redirect")
+	require.NoError(t, err)
+	defer response.Body.Close()
+
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "200 OK", response.Status)
+	require.Equal(t, "HTTP/2.0", response.Proto)
+	require.Equal(t, []string{"a=1", "b=2"}, response.Header.Values("Set-Cookie"))
+	require.Equal(t, "/final", response.Request.URL.Path)
+	require.Equal(t, []string{baseURL + "/redirect", baseURL + "/final"}, cronet.ResponseURLChain(response))
+	content, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(content))
+}
+
+func TestRoundTripperClientTrace(t *testing.T) {
+	engine, baseURL := startHTTPSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+
+	var (
+		access sync.Mutex
+		events []string
+		done   = make(chan struct{})
+	)
+	record := func(event string) {
+		access.Lock()
+		events = append(events, event)
+		access.Unlock()
+	}
+	trace := &httptrace.ClientTrace{
+		GetConn:              func(string) { record("GetConn") },
+		DNSStart:             func(httptrace.DNSStartInfo) { record("DNSStart") },
+		ConnectStart:         func(string, string) { record("ConnectStart") },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { record("TLSHandshakeDone") },
+		GotConn:              func(info httptrace.GotConnInfo) { record("GotConn") },
+		GotFirstResponseByte: func() { record("GotFirstResponseByte") },
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			record("WroteRequest")
+			close(done)
+		},
+	}
+	request, err := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, baseURL, nil)
+	require.NoError(t, err)
+	response, err := (&cronet.RoundTripper{Engine: engine}).RoundTrip(request)
+	require.NoError(t, err)
+	_, err = io.Copy(io.Discard, response.Body)
+	require.NoError(t, err)
+	response.Body.Close()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("trace was not replayed")
+	}
+	access.Lock()
+	defer access.Unlock()
+	for _, event := range []string{"GetConn", "DNSStart", "ConnectStart", "TLSHandshakeDone", "GotConn", "GotFirstResponseByte", "WroteRequest"} {
+		require.Contains(t, events, event)
+	}
+}
+
+func TestRoundTripperRedirectPolicy(t *testing.T) {
+	engine, baseURL := startHTTPSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/submit":
+			http.Redirect(w, r, "/result", http.StatusSeeOther)
+		default:
+			io.WriteString(w, r.Method)
+		}
+	}))
+
+	var viaCount int
+	transport := &cronet.RoundTripper{
+		Engine: engine,
+		RedirectPolicy: func(request *http.Request, via []*http.Request) error {
+			viaCount = len(via)
+			return nil
+		},
+	}
+	request, err := http.NewRequest(http.MethodPost, baseURL+"/submit", strings.NewReader("form"))
+	require.NoError(t, err)
+	response, err := transport.RoundTrip(request)
+	require.NoError(t, err)
+	content, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	response.Body.Close()
+	require.Equal(t, http.MethodGet, string(content))
+	require.Equal(t, 1, viaCount)
+
+	transport.RedirectPolicy = func(request *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	request, err = http.NewRequest(http.MethodPost, baseURL+"/submit", strings.NewReader("form"))
+	require.NoError(t, err)
+	response, err = transport.RoundTrip(request)
+	require.NoError(t, err)
+	require.Equal(t, http.StatusSeeOther, response.StatusCode)
+	require.Equal(t, "/result", response.Header.Get("Location"))
+	require.NoError(t, response.Body.Close())
+}
+
+func TestRoundTripperCookieJar(t *testing.T) {
+	engine, baseURL := startHTTPSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "secret", Path: "/"})
+			http.Redirect(w, r, "/whoami", http.StatusFound)
+		case "/whoami":
+			cookie, err := r.Cookie("session")
+			if err != nil {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			io.WriteString(w, cookie.Value)
+		}
+	}))
+
+	jar, err := cookiejar.New(nil)
+	require.NoError(t, err)
+	client := &http.Client{Transport: &cronet.RoundTripper{Engine: engine, Jar: jar}}
+	response, err := client.Get(baseURL + "/login")
+	require.NoError(t, err)
+	content, err := io.ReadAll(response.Body)
+	require.NoError(t, err)
+	response.Body.Close()
+	require.Equal(t, http.StatusOK, response.StatusCode)
+	require.Equal(t, "secret", string(content))
+}
+
+func TestRoundTripperRequestStatus(t *testing.T) {
+	release := make(chan struct{})
+	engine, baseURL := startHTTPSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "hello")
+	}))
+
+	ctx, status := cronet.WithRequestStatus(context.Background())
+	require.Equal(t, cronet.URLRequestStatusListenerStatusInvalid, status.Status())
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL, nil)
+	require.NoError(t, err)
+	responseChan := make(chan *http.Response, 1)
+	go func() {
+		response, err := (&cronet.RoundTripper{Engine: engine}).RoundTrip(request)
+		if err == nil {
+			responseChan <- response
+		}
+		close(responseChan)
+	}()
+
+	require.Eventually(t, func() bool {
+		return status.Status() == cronet.URLRequestStatusListenerStatusWaitingForResponse
+	}, 5*time.Second, 10*time.Millisecond)
+	close(release)
+
+	response := <-responseChan
+	require.NotNil(t, response)
+	_, err = io.Copy(io.Discard, response.Body)
+	require.NoError(t, err)
+	response.Body.Close()
+	require.Equal(t, cronet.URLRequestStatusListenerStatusInvalid, status.Status())
+}
+
+func TestRoundTripperRequestStatusCanceled(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	engine, baseURL := startHTTPSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ctx, status := cronet.WithRequestStatus(ctx)
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL, nil)
+	require.NoError(t, err)
+	roundTripDone := make(chan struct{})
+	go func() {
+		defer close(roundTripDone)
+		response, err := (&cronet.RoundTripper{Engine: engine}).RoundTrip(request)
+		if err == nil {
+			response.Body.Close()
+		}
+	}()
+	require.Eventually(t, func() bool {
+		return status.Status() == cronet.URLRequestStatusListenerStatusWaitingForResponse
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Status queries racing the cancellation return instead of waiting for a
+	// report that may never come.
+	var group sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		group.Add(1)
+		go func() {
+			defer group.Done()
+			for {
+				select {
+				case <-roundTripDone:
+					return
+				default:
+				}
+				status.Status()
+			}
+		}()
+	}
+	cancel()
+	<-roundTripDone
+	statusDone := make(chan struct{})
+	go func() {
+		group.Wait()
+		close(statusDone)
+	}()
+	select {
+	case <-statusDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Status blocked after the request was canceled")
+	}
+	require.Equal(t, cronet.URLRequestStatusListenerStatusInvalid, status.Status())
+}
+
+func TestRoundTripperCloseDuringRead(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	engine, baseURL := startHTTPSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "first")
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	transport := &cronet.RoundTripper{Engine: engine}
+
+	// Each round leaves a read pending on the native buffer when the body
+	// is closed; the buffers must neither be reused while Cronet owns them
+	// nor be lost from the pool.
+	for i := 0; i < 20; i++ {
+		request, err := http.NewRequest(http.MethodGet, baseURL, nil)
+		require.NoError(t, err)
+		response, err := transport.RoundTrip(request)
+		require.NoError(t, err)
+		buffer := make([]byte, 5)
+		_, err = io.ReadFull(response.Body, buffer)
+		require.NoError(t, err)
+		require.Equal(t, "first", string(buffer))
+
+		readErr := make(chan error, 1)
+		go func() {
+			_, err := response.Body.Read(buffer)
+			readErr <- err
+		}()
+		time.Sleep(20 * time.Millisecond)
+		require.NoError(t, response.Body.Close())
+		select {
+		case err = <-readErr:
+			require.ErrorIs(t, err, net.ErrClosed)
+		case <-time.After(5 * time.Second):
+			t.Fatal("pending read did not return after Close")
+		}
+		_, err = response.Body.Read(buffer)
+		require.Error(t, err)
+	}
+	require.NoError(t, transport.Close())
+}
+
+func TestRoundTripperClose(t *testing.T) {
+	caPem, certPem, keyPem := generateCertificate(t, "example.org")
+	caPemContent, err := os.ReadFile(caPem)
+	require.NoError(t, err)
+	certificate, err := tls.LoadX509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+
+	release := make(chan struct{})
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		io.WriteString(w, "hello")
+	}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	baseURL := fmt.Sprintf("https://example.org:%d", server.Listener.Addr().(*net.TCPAddr).Port)
+
+	transport, err := cronet.NewRoundTripper(cronet.RoundTripperOptions{
+		ConfigureEngine: func(engine cronet.Engine, params cronet.EngineParams) error {
+			if !engine.SetTrustedRootCertificates(string(caPemContent)) {
+				return errors.New("failed to set trusted root certificates")
+			}
+			return params.SetHostResolverRules("MAP example.org 127.0.0.1")
+		},
+	})
+	require.NoError(t, err)
+
+	request, err := http.NewRequest(http.MethodGet, baseURL, nil)
+	require.NoError(t, err)
+	responseChan := make(chan *http.Response, 1)
+	go func() {
+		response, err := transport.RoundTrip(request)
+		if err == nil {
+			responseChan <- response
+		}
+		close(responseChan)
+	}()
+
+	closed := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() {
+		go func() {
+			transport.Close()
+			close(closed)
+		}()
+		close(release)
+	})
+	response := <-responseChan
+	require.NotNil(t, response)
+	// The body is left unread, so the request is still in flight until the
+	// body is closed.
+	select {
+	case <-closed:
+		t.Fatal("Close returned before the response body was closed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	response.Body.Close()
+	<-closed
+
+	_, err = transport.RoundTrip(request)
+	require.ErrorIs(t, err, net.ErrClosed)
+	require.ErrorIs(t, transport.Close(), net.ErrClosed)
+}
+
+func TestRoundTripperWorkerPoolExecutor(t *testing.T) {
+	engine, baseURL := startHTTPSServer(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+
+	executor, err := cronet.NewWorkerPoolExecutor(2, 16, cronet.ExecutorOptions{})
+	require.NoError(t, err)
+	transport := &cronet.RoundTripper{Engine: engine, Executor: executor.Executor}
+	var group sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		group.Add(1)
+		go func(path string) {
+			defer group.Done()
+			request, err := http.NewRequest(http.MethodGet, baseURL+path, nil)
+			if !assert.NoError(t, err) {
+				return
+			}
+			response, err := transport.RoundTrip(request)
+			if !assert.NoError(t, err) {
+				return
+			}
+			defer response.Body.Close()
+			content, err := io.ReadAll(response.Body)
+			assert.NoError(t, err)
+			assert.Equal(t, path, string(content))
+		}(fmt.Sprint("/", i))
+	}
+	group.Wait()
+	require.NoError(t, transport.Close())
+	require.NoError(t, executor.Close())
+	require.Equal(t, cronet.ExecutorStats{}, executor.Stats())
+}
+
+func TestRoundTripperHTTPCache(t *testing.T) {
+	caPem, certPem, keyPem := generateCertificate(t, "example.org")
+	caPemContent, err := os.ReadFile(caPem)
+	require.NoError(t, err)
+	certificate, err := tls.LoadX509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+
+	var hits atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Cache-Control", "max-age=3600")
+		io.WriteString(w, "hello")
+	}))
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	baseURL := fmt.Sprintf("https://example.org:%d", server.Listener.Addr().(*net.TCPAddr).Port)
+
+	transport, err := cronet.NewRoundTripper(cronet.RoundTripperOptions{
+		HTTPCacheMode:    cronet.HTTPCacheModeDisk,
+		HTTPCacheMaxSize: 1 << 20,
+		StoragePath:      t.TempDir(),
+		ConfigureEngine: func(engine cronet.Engine, params cronet.EngineParams) error {
+			if !engine.SetTrustedRootCertificates(string(caPemContent)) {
+				return errors.New("failed to set trusted root certificates")
+			}
+			return params.SetHostResolverRules("MAP example.org 127.0.0.1")
+		},
+	})
+	require.NoError(t, err)
+	defer transport.Close()
+
+	get := func(ctx context.Context) bool {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, baseURL, nil)
+		require.NoError(t, err)
+		response, err := transport.RoundTrip(request)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		content, err := io.ReadAll(response.Body)
+		require.NoError(t, err)
+		require.Equal(t, "hello", string(content))
+		return cronet.ResponseCached(response)
+	}
+	require.False(t, get(context.Background()))
+	require.True(t, get(context.Background()))
+	require.Equal(t, int32(1), hits.Load())
+	require.False(t, get(cronet.WithDisableCache(context.Background())))
+	require.Equal(t, int32(2), hits.Load())
+}
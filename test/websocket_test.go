@@ -0,0 +1,175 @@
+package test
+
+import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	cronet "github.com/sagernet/cronet-go"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2/hpack"
+)
+
+func TestWebSocketDialerExtendedConnect(t *testing.T) {
+	caPem, certPem, keyPem := generateCertificate(t, "example.org")
+	caPemContent, err := os.ReadFile(caPem)
+	require.NoError(t, err)
+	certificate, err := tls.LoadX509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+
+	requestHeaders := make(chan map[string]string, 1)
+	port := startExtendedConnectServer(t, certificate, requestHeaders, extendedConnectHandler{
+		responseFields: []hpack.HeaderField{{Name: "sec-websocket-protocol", Value: "chat"}},
+		consume:        echoWebSocketFrames,
+	})
+
+	engine := cronet.NewEngine()
+	require.True(t, engine.SetTrustedRootCertificates(string(caPemContent)))
+	params := cronet.NewEngineParams()
+	require.NoError(t, params.SetHostResolverRules("MAP example.org 127.0.0.1"))
+	require.Equal(t, cronet.ResultSuccess, engine.StartWithParams(params))
+	params.Destroy()
+	t.Cleanup(func() {
+		engine.Shutdown()
+		engine.Destroy()
+	})
+
+	dialer := &cronet.WebSocketDialer{
+		Engine:       engine,
+		Subprotocols: []string{"chat"},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, fmt.Sprintf("wss://example.org:%d/chat", port))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	headers := <-requestHeaders
+	require.Equal(t, http.MethodConnect, headers[":method"])
+	require.Equal(t, "websocket", headers[":protocol"])
+	require.Equal(t, "https", headers[":scheme"])
+	require.Equal(t, "/chat", headers[":path"])
+	require.Equal(t, fmt.Sprintf("example.org:%d", port), headers[":authority"])
+	require.Equal(t, "13", headers["sec-websocket-version"])
+	require.Equal(t, "chat", conn.Subprotocol())
+	require.Equal(t, 2, conn.Response().ProtoMajor)
+
+	require.NoError(t, conn.WriteMessage(cronet.WebSocketTextMessage, []byte("hello")))
+	messageType, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, cronet.WebSocketTextMessage, messageType)
+	require.Equal(t, "hello", string(message))
+}
+
+// echoWebSocketFrames echoes short masked client frames back unmasked.
+func echoWebSocketFrames(pending []byte, write func([]byte)) []byte {
+	for len(pending) >= 6 && len(pending) >= 6+int(pending[1]&0x7f) {
+		length := int(pending[1] & 0x7f)
+		payload := make([]byte, length)
+		for i := range payload {
+			payload[i] = pending[6+i] ^ pending[2+i%4]
+		}
+		write(append([]byte{pending[0], byte(length)}, payload...))
+		pending = pending[6+length:]
+	}
+	return pending
+}
+
+func TestWebSocketDialerHTTP1Fallback(t *testing.T) {
+	caPem, certPem, keyPem := generateCertificate(t, "example.org")
+	caPemContent, err := os.ReadFile(caPem)
+	require.NoError(t, err)
+	certificate, err := tls.LoadX509KeyPair(certPem, keyPem)
+	require.NoError(t, err)
+
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hash := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+		conn, readWriter, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		fmt.Fprint(readWriter, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+		fmt.Fprint(readWriter, "Sec-WebSocket-Protocol: chat\r\n")
+		fmt.Fprintf(readWriter, "Sec-WebSocket-Accept: %s\r\n\r\n", base64.StdEncoding.EncodeToString(hash[:]))
+		readWriter.Flush()
+		// Echo one short masked client frame back unmasked.
+		header := make([]byte, 6)
+		if _, err = io.ReadFull(readWriter, header); err != nil {
+			return
+		}
+		payload := make([]byte, header[1]&0x7f)
+		if _, err = io.ReadFull(readWriter, payload); err != nil {
+			return
+		}
+		for i := range payload {
+			payload[i] ^= header[2+i%4]
+		}
+		conn.Write(append([]byte{header[0], byte(len(payload))}, payload...))
+		io.Copy(io.Discard, conn)
+	}))
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	t.Cleanup(server.Close)
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+
+	engine := cronet.NewEngine()
+	require.True(t, engine.SetTrustedRootCertificates(string(caPemContent)))
+	params := cronet.NewEngineParams()
+	require.NoError(t, params.SetHostResolverRules("MAP example.org 127.0.0.1"))
+	require.Equal(t, cronet.ResultSuccess, engine.StartWithParams(params))
+	params.Destroy()
+	t.Cleanup(func() {
+		engine.Shutdown()
+		engine.Destroy()
+	})
+
+	rootCAs := x509.NewCertPool()
+	require.True(t, rootCAs.AppendCertsFromPEM(caPemContent))
+	dialer := &cronet.WebSocketDialer{
+		Engine:              engine,
+		Subprotocols:        []string{"chat"},
+		EnableHTTP1Fallback: true,
+		Dialer:              staticDialer{destination: M.ParseSocksaddrHostPort("127.0.0.1", uint16(port))},
+		TLSConfig:           &tls.Config{RootCAs: rootCAs},
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	conn, err := dialer.DialContext(ctx, fmt.Sprintf("wss://example.org:%d/chat", port))
+	require.NoError(t, err)
+	defer conn.Close()
+	require.Equal(t, "chat", conn.Subprotocol())
+	require.Equal(t, 1, conn.Response().ProtoMajor)
+
+	require.NoError(t, conn.WriteMessage(cronet.WebSocketTextMessage, []byte("hello")))
+	messageType, message, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Equal(t, cronet.WebSocketTextMessage, messageType)
+	require.Equal(t, "hello", string(message))
+}
+
+// staticDialer dials a fixed destination, standing in for DNS in the HTTP/1.1 fallback.
+type staticDialer struct {
+	destination M.Socksaddr
+}
+
+func (d staticDialer) DialContext(ctx context.Context, network string, destination M.Socksaddr) (net.Conn, error) {
+	return N.SystemDialer.DialContext(ctx, network, d.destination)
+}
+
+func (d staticDialer) ListenPacket(ctx context.Context, destination M.Socksaddr) (net.PacketConn, error) {
+	return N.SystemDialer.ListenPacket(ctx, d.destination)
+}
@@ -5,33 +5,151 @@ import (
 	"io"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync"
+
+	E "github.com/sagernet/sing/common/exceptions"
 )
 
 // RoundTripper is a wrapper from URLRequest to http.RoundTripper
+//
+// Use NewRoundTripper to create a RoundTripper with an explicitly configured
+// engine and release it with Close. A zero RoundTripper lazily creates a default
+// engine and executor on first use, which are only released by Close or when
+// the RoundTripper is garbage collected.
 type RoundTripper struct {
+	// CheckRedirect is called with the absolute URL of each redirect target,
+	// and the redirect response is returned if it returns false. It is only
+	// used if RedirectPolicy is nil.
+	//
+	// Deprecated: Use RedirectPolicy.
 	CheckRedirect func(newLocationUrl string) bool
-	Engine        Engine
-	Executor      Executor
+	// RedirectPolicy specifies the policy for handling redirects, with the same
+	// semantics as http.Client.CheckRedirect. If both it and CheckRedirect are
+	// nil, RoundTripper stops after 10 consecutive redirects.
+	RedirectPolicy func(request *http.Request, via []*http.Request) error
+	// Jar specifies an optional cookie jar. If set, cookies from the jar are
+	// sent on every hop, including redirects, and Set-Cookie values from every
+	// response are stored in it.
+	Jar      http.CookieJar
+	Engine   Engine
+	Executor Executor
+
+	initOnce       sync.Once
+	access         sync.RWMutex
+	closed         bool
+	activeRequests sync.WaitGroup
+	closeEngine    bool
+	closeExecutor  bool
+}
 
-	closeEngine   bool
-	closeExecutor bool
+// RoundTripperOptions configures the engine created by NewRoundTripper.
+type RoundTripperOptions struct {
+	// UserAgent defaults to "Go-http-client/1.1".
+	UserAgent      string
+	AcceptLanguage string
+	DisableHTTP2   bool
+	DisableQUIC    bool
+	DisableBrotli  bool
+	// HTTPCacheMode enables the HTTP cache. Disk modes require StoragePath.
+	// Use WithDisableCache to bypass the cache for a single request.
+	HTTPCacheMode EngineParamsHTTPCacheMode
+	// HTTPCacheMaxSize is the maximum size of the HTTP cache in bytes.
+	// If zero, Cronet picks a default size.
+	HTTPCacheMaxSize int64
+	// StoragePath is an existing directory for the disk cache and other
+	// persistent engine state.
+	StoragePath string
+	// Executor runs Cronet callbacks. If zero, a goroutine-per-callback executor
+	// owned by the RoundTripper is used.
+	Executor       Executor
+	RedirectPolicy func(request *http.Request, via []*http.Request) error
+	Jar            http.CookieJar
+	// ConfigureEngine is called with the engine and its params before the engine
+	// starts, to set options not covered by RoundTripperOptions.
+	ConfigureEngine func(engine Engine, params EngineParams) error
 }
 
-func (t *RoundTripper) close() {
-	if t.closeEngine {
-		t.Engine.Shutdown()
-		t.Engine.Destroy()
+// NewRoundTripper creates a RoundTripper and starts its engine.
+func NewRoundTripper(options RoundTripperOptions) (*RoundTripper, error) {
+	err := checkLibrary()
+	if err != nil {
+		return nil, err
 	}
-	if t.closeExecutor {
-		t.Executor.Destroy()
+	userAgent := options.UserAgent
+	if userAgent == "" {
+		userAgent = "Go-http-client/1.1"
+	}
+	params := NewEngineParams()
+	defer params.Destroy()
+	params.SetUserAgent(userAgent)
+	if options.AcceptLanguage != "" {
+		params.SetAcceptLanguage(options.AcceptLanguage)
+	}
+	params.SetEnableHTTP2(!options.DisableHTTP2)
+	params.SetEnableQuic(!options.DisableQUIC)
+	params.SetEnableBrotli(!options.DisableBrotli)
+	if options.StoragePath != "" {
+		params.SetStoragePath(options.StoragePath)
+	}
+	switch options.HTTPCacheMode {
+	case HTTPCacheModeDisabled:
+	case HTTPCacheModeInMemory:
+	case HTTPCacheModeDiskNoHTTP, HTTPCacheModeDisk:
+		if options.StoragePath == "" {
+			return nil, E.New("storage path is required for disk HTTP cache")
+		}
+	default:
+		return nil, E.New("unknown HTTP cache mode: ", int(options.HTTPCacheMode))
+	}
+	params.SetHTTPCacheMode(options.HTTPCacheMode)
+	if options.HTTPCacheMaxSize > 0 {
+		params.SetHTTPCacheMaxSize(options.HTTPCacheMaxSize)
+	}
+	engine := NewEngine()
+	if options.ConfigureEngine != nil {
+		err = options.ConfigureEngine(engine, params)
+		if err != nil {
+			engine.Destroy()
+			return nil, err
+		}
+	}
+	result := engine.StartWithParams(params)
+	if result != ResultSuccess {
+		engine.Destroy()
+		return nil, E.New("failed to start engine: ", int(result))
 	}
+	t := &RoundTripper{
+		RedirectPolicy: options.RedirectPolicy,
+		Jar:            options.Jar,
+		Engine:         engine,
+		Executor:       options.Executor,
+		closeEngine:    true,
+	}
+	var emptyExecutor Executor
+	if t.Executor == emptyExecutor {
+		t.Executor = newGoroutineExecutor()
+		t.closeExecutor = true
+	}
+	t.initOnce.Do(func() {})
+	return t, nil
 }
 
-func (t *RoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+func newGoroutineExecutor() Executor {
+	return NewExecutor(func(executor Executor, command Runnable) {
+		go func() {
+			command.Run()
+			command.Destroy()
+		}()
+	})
+}
+
+// initDefault creates the engine and executor of a zero RoundTripper.
+func (t *RoundTripper) initDefault() {
 	var emptyEngine Engine
 	if t.Engine == emptyEngine {
 		engineParams := NewEngineParams()
@@ -43,21 +161,91 @@ func (t *RoundTripper) RoundTrip(request *http.Request) (*http.Response, error)
 		t.Engine.StartWithParams(engineParams)
 		engineParams.Destroy()
 		t.closeEngine = true
-		runtime.SetFinalizer(t, (*RoundTripper).close)
 	}
 	var emptyExecutor Executor
 	if t.Executor == emptyExecutor {
-		t.Executor = NewExecutor(func(executor Executor, command Runnable) {
-			go func() {
-				command.Run()
-				command.Destroy()
-			}()
-		})
+		t.Executor = newGoroutineExecutor()
 		t.closeExecutor = true
-		if !t.closeEngine {
-			runtime.SetFinalizer(t, (*RoundTripper).close)
+	}
+	if t.closeEngine || t.closeExecutor {
+		runtime.SetFinalizer(t, (*RoundTripper).close)
+	}
+}
+
+func (t *RoundTripper) close() {
+	if t.closeEngine {
+		t.Engine.Shutdown()
+		t.Engine.Destroy()
+	}
+	if t.closeExecutor {
+		t.Executor.Destroy()
+	}
+}
+
+// Close stops accepting new requests, waits for in-flight requests to finish,
+// and then releases the engine and executor owned by the RoundTripper. A
+// request is in flight until its response body is read to EOF or closed.
+func (t *RoundTripper) Close() error {
+	t.access.Lock()
+	if t.closed {
+		t.access.Unlock()
+		return net.ErrClosed
+	}
+	t.closed = true
+	t.access.Unlock()
+
+	t.activeRequests.Wait()
+	t.initOnce.Do(func() {})
+	runtime.SetFinalizer(t, nil)
+	t.close()
+	return nil
+}
+
+func (t *RoundTripper) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.initOnce.Do(t.initDefault)
+
+	var (
+		via      []*http.Request
+		urlChain []string
+	)
+	for {
+		urlChain = append(urlChain, request.URL.String())
+		response, err := t.roundTrip(request)
+		if err != nil {
+			return nil, err
+		}
+		response.urlChain = urlChain
+		if t.Jar != nil {
+			if cookies := response.response.Cookies(); len(cookies) > 0 {
+				t.Jar.SetCookies(request.URL, cookies)
+			}
+		}
+		if response.redirectLocation == "" {
+			return &response.response, nil
+		}
+		nextRequest, err := t.redirectRequest(request, response, via)
+		if err != nil {
+			response.Close()
+			return nil, err
+		}
+		if nextRequest == nil {
+			return &response.response, nil
 		}
+		response.Close()
+		via = append(via, request)
+		request = nextRequest
 	}
+}
+
+func (t *RoundTripper) roundTrip(request *http.Request) (*urlResponse, error) {
+	t.access.RLock()
+	if t.closed {
+		t.access.RUnlock()
+		closeRequestBody(request)
+		return nil, net.ErrClosed
+	}
+	t.activeRequests.Add(1)
+	t.access.RUnlock()
 
 	requestParams := NewURLRequestParams()
 	if request.Method == "" {
@@ -65,7 +253,12 @@ func (t *RoundTripper) RoundTrip(request *http.Request) (*http.Response, error)
 	} else {
 		requestParams.SetMethod(request.Method)
 	}
+	requestOptions := contextRequestOptions(request.Context())
+	requestOptions.apply(requestParams)
 	for key, values := range request.Header {
+		if t.Jar != nil && http.CanonicalHeaderKey(key) == "Cookie" {
+			continue
+		}
 		for _, value := range values {
 			header := NewHTTPHeader()
 			header.SetName(key)
@@ -74,54 +267,90 @@ func (t *RoundTripper) RoundTrip(request *http.Request) (*http.Response, error)
 			header.Destroy()
 		}
 	}
+	if t.Jar != nil {
+		if cookie := requestCookieHeader(request, t.Jar); cookie != "" {
+			header := NewHTTPHeader()
+			header.SetName("Cookie")
+			header.SetValue(cookie)
+			requestParams.AddHeader(header)
+			header.Destroy()
+		}
+	}
+	progress := newProgressReporter(requestOptions, request.ContentLength)
 	if request.Body != nil {
-		uploadProvider := NewUploadDataProvider(&bodyUploadProvider{request.Body, request.GetBody, request.ContentLength})
+		uploadProvider := NewUploadDataProvider(&bodyUploadProvider{request.Body, request.GetBody, request.ContentLength, progress})
 		requestParams.SetUploadDataProvider(uploadProvider)
 		requestParams.SetUploadDataExecutor(t.Executor)
 	}
-	responseHandler := urlResponse{
-		checkRedirect: t.CheckRedirect,
-		roundTripper:  t,
+	trace := newRequestTrace(httptrace.ContextClientTrace(request.Context()), request.URL)
+	if trace != nil {
+		requestParams.SetRequestFinishedListener(trace.listener())
+		requestParams.SetRequestFinishedExecutor(t.Executor)
+		trace.getConn()
+	}
+	responseHandler := &urlResponse{
+		trace:        trace,
+		progress:     progress,
+		roundTripper: t,
 		response: http.Response{
-			Request:    request,
-			Proto:      request.Proto,
-			ProtoMajor: request.ProtoMajor,
-			ProtoMinor: request.ProtoMinor,
-			Header:     make(http.Header),
+			Request: request,
+			Header:  make(http.Header),
 		},
 		read:   make(chan int),
 		cancel: make(chan struct{}),
 		done:   make(chan struct{}),
 	}
-	responseHandler.response.Body = &responseHandler
+	responseHandler.response.Body = responseHandler
 	responseHandler.wg.Add(1)
 	go responseHandler.monitorContext(request.Context())
 
-	callback := NewURLRequestCallback(&responseHandler)
+	callback := NewURLRequestCallback(responseHandler)
 	urlRequest := NewURLRequest()
 	responseHandler.request = urlRequest
 	urlRequest.InitWithParams(t.Engine, request.URL.String(), requestParams, callback, t.Executor)
 	requestParams.Destroy()
 	urlRequest.Start()
+	if requestOptions.status != nil {
+		requestOptions.status.setResponse(responseHandler)
+	}
 	responseHandler.wg.Wait()
-	return &responseHandler.response, responseHandler.err
+	if responseHandler.err != nil {
+		return nil, responseHandler.err
+	}
+	return responseHandler, nil
 }
 
-type urlResponse struct {
-	checkRedirect func(newLocationUrl string) bool
-
-	wg           sync.WaitGroup
-	wgDone       sync.Once
-	request      URLRequest
-	response     http.Response
-	err          error
-	roundTripper *RoundTripper // prevent GC from finalizing RoundTripper while request is in progress
+// requestCookieHeader merges the Cookie header of request with the cookies
+// stored in jar for its URL into a single header value.
+func requestCookieHeader(request *http.Request, jar http.CookieJar) string {
+	values := request.Header.Values("Cookie")
+	for _, cookie := range jar.Cookies(request.URL) {
+		values = append(values, (&http.Cookie{Name: cookie.Name, Value: cookie.Value}).String())
+	}
+	return strings.Join(values, "; ")
+}
 
-	access     sync.Mutex
-	read       chan int
-	readBuffer Buffer
-	cancel     chan struct{}
-	done       chan struct{}
+type urlResponse struct {
+	wg               sync.WaitGroup
+	wgDone           sync.Once
+	request          URLRequest
+	response         http.Response
+	urlChain         []string
+	redirectLocation string
+	cached           bool
+	trace            *requestTrace
+	progress         *progressReporter
+	err              error
+	roundTripper     *RoundTripper // prevent GC from finalizing RoundTripper while request is in progress
+
+	access      sync.Mutex
+	reading     sync.Mutex
+	read        chan int
+	readBuffer  Buffer
+	readPending bool
+	readData    []byte
+	cancel      chan struct{}
+	done        chan struct{}
 }
 
 func (r *urlResponse) monitorContext(ctx context.Context) {
@@ -138,66 +367,212 @@ func (r *urlResponse) monitorContext(ctx context.Context) {
 }
 
 func (r *urlResponse) OnRedirectReceived(self URLRequestCallback, request URLRequest, info URLResponseInfo, newLocationUrl string) {
-	if r.checkRedirect != nil && !r.checkRedirect(newLocationUrl) {
-		r.response.Status = info.StatusText()
-		r.response.StatusCode = info.StatusCode()
-		headerLen := info.HeaderSize()
-		for i := 0; i < headerLen; i++ {
-			header := info.HeaderAt(i)
-			r.response.Header.Set(header.Name(), header.Value())
-		}
-		r.response.Body = io.NopCloser(io.MultiReader())
-		r.wg.Done()
-		return
+	if r.trace != nil {
+		r.trace.gotFirstResponseByte()
 	}
-	request.FollowRedirect()
+	// Redirects are followed by RoundTrip with a new request, the same way
+	// http.Client does, so the paused request is only canceled afterwards.
+	r.setResponseInfo(info)
+	r.redirectLocation = newLocationUrl
+	r.wgDone.Do(r.wg.Done)
 }
 
 func (r *urlResponse) OnResponseStarted(self URLRequestCallback, request URLRequest, info URLResponseInfo) {
-	r.response.Status = info.StatusText()
-	r.response.StatusCode = info.StatusCode()
-	headerLen := info.HeaderSize()
+	if r.trace != nil {
+		r.trace.gotFirstResponseByte()
+	}
+	r.setResponseInfo(info)
+	r.wgDone.Do(r.wg.Done)
+}
 
+// setResponseInfo maps info to r.response the same way net/http.Transport
+// populates a response read from the wire.
+func (r *urlResponse) setResponseInfo(info URLResponseInfo) {
+	response := &r.response
+	response.StatusCode = info.StatusCode()
+	response.Status = strconv.Itoa(response.StatusCode) + " " + info.StatusText()
+	response.Proto, response.ProtoMajor, response.ProtoMinor = httpProtoFromNegotiated(info.NegotiatedProtocol())
+	r.cached = info.Cached()
+	headerLen := info.HeaderSize()
 	for i := 0; i < headerLen; i++ {
 		header := info.HeaderAt(i)
-		r.response.Header.Set(header.Name(), header.Value())
+		response.Header.Add(header.Name(), header.Value())
+	}
+
+	response.ContentLength = -1
+	if contentLength, err := strconv.ParseInt(response.Header.Get("Content-Length"), 10, 64); err == nil && contentLength >= 0 {
+		response.ContentLength = contentLength
+	}
+	if transferEncoding := response.Header.Values("Transfer-Encoding"); len(transferEncoding) > 0 {
+		response.TransferEncoding = transferEncoding
+		response.Header.Del("Transfer-Encoding")
+		response.ContentLength = -1
+	}
+	// Cronet always decodes the content codings it advertised, so the body
+	// no longer matches Content-Encoding and Content-Length.
+	if isDecodedContentEncoding(response.Header.Get("Content-Encoding")) {
+		response.Uncompressed = true
+		response.Header.Del("Content-Encoding")
+		response.Header.Del("Content-Length")
+		response.ContentLength = -1
+	}
+	if r.progress != nil {
+		r.progress.setTotalReceive(response.ContentLength)
+	}
+}
+
+func isDecodedContentEncoding(contentEncoding string) bool {
+	switch strings.ToLower(strings.TrimSpace(contentEncoding)) {
+	case "gzip", "x-gzip", "deflate", "br", "zstd":
+		return true
+	default:
+		return false
 	}
-	contentLength, _ := strconv.Atoi(r.response.Header.Get("Content-Length"))
-	r.response.ContentLength = int64(contentLength)
-	r.response.TransferEncoding = r.response.Header.Values("Content-Transfer-Encoding")
-	r.wgDone.Do(r.wg.Done)
+}
+
+// ResponseURLChain returns the URLs visited by a response returned from RoundTripper,
+// starting with the original request URL and ending with the final URL.
+// The final URL is also available as response.Request.URL.
+// It returns nil for other responses.
+//
+// The chain is built by RoundTripper from the redirect hops it followed itself,
+// one Cronet request per hop, not from Cronet's URLResponseInfo.URLChainAt, so
+// it does not include redirects handled inside Cronet. When a redirect response
+// is returned, for example because RedirectPolicy returned
+// http.ErrUseLastResponse, the chain ends with the URL of that response.
+func ResponseURLChain(response *http.Response) []string {
+	body, loaded := response.Body.(*urlResponse)
+	if !loaded {
+		return nil
+	}
+	return body.urlChain
+}
+
+// ResponseCached reports whether response was served from the HTTP cache.
+// It returns false for responses not created by RoundTripper.
+func ResponseCached(response *http.Response) bool {
+	body, loaded := response.Body.(*urlResponse)
+	if !loaded {
+		return false
+	}
+	return body.cached
 }
 
 func (r *urlResponse) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	r.reading.Lock()
+	defer r.reading.Unlock()
+	defer r.releaseIfClosed()
+	if len(r.readData) == 0 {
+		err = r.fill()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n = copy(p, r.readData)
+	r.readData = r.readData[n:]
+	return n, nil
+}
+
+// WriteTo implements io.WriterTo by writing the native read buffer directly to w,
+// which saves io.Copy an intermediate copy.
+func (r *urlResponse) WriteTo(w io.Writer) (n int64, err error) {
+	r.reading.Lock()
+	defer r.reading.Unlock()
+	defer r.releaseIfClosed()
+	for {
+		if len(r.readData) == 0 {
+			err = r.fill()
+			if err == io.EOF {
+				return n, nil
+			} else if err != nil {
+				return n, err
+			}
+		}
+		written, writeErr := w.Write(r.readData)
+		n += int64(written)
+		r.readData = r.readData[written:]
+		if writeErr != nil {
+			return n, writeErr
+		}
+	}
+}
+
+// fill reads the next chunk of the response body into the native read buffer.
+// It must be called with r.reading held.
+func (r *urlResponse) fill() error {
+	if r.redirectLocation != "" {
+		// Cronet does not expose the body of a redirect response.
+		return io.EOF
+	}
 	select {
 	case <-r.done:
-		return 0, r.err
+		r.releaseReadBuffer()
+		return r.err
 	default:
 	}
 
+	// Close cancels the request under r.access, so checking r.cancel here
+	// ensures no Read is issued on a request being canceled.
 	r.access.Lock()
-
 	select {
 	case <-r.done:
-		return 0, r.err
+		r.access.Unlock()
+		r.releaseReadBuffer()
+		return r.err
+	case <-r.cancel:
+		r.access.Unlock()
+		r.releaseReadBuffer()
+		return net.ErrClosed
 	default:
 	}
-
-	r.readBuffer = NewBuffer()
-	r.readBuffer.InitWithDataAndCallback(p, NewBufferCallback(nil))
-	r.request.Read(r.readBuffer)
+	if r.readBuffer.ptr == 0 {
+		r.readBuffer = acquireReadBuffer()
+	}
+	r.readPending = true
+	result := r.request.Read(r.readBuffer)
+	if result != ResultSuccess {
+		// Cronet did not take the buffer.
+		r.readPending = false
+		r.access.Unlock()
+		r.releaseReadBuffer()
+		return E.New("read response body: ", int(result))
+	}
 	r.access.Unlock()
 
 	select {
 	case bytesRead := <-r.read:
-		return bytesRead, nil
+		r.readData = r.readBuffer.DataSlice()[:bytesRead]
+		return nil
 	case <-r.cancel:
-		return 0, net.ErrClosed
+		<-r.done
+		r.releaseReadBuffer()
+		return net.ErrClosed
 	case <-r.done:
-		return 0, r.err
+		r.releaseReadBuffer()
+		return r.err
 	}
 }
 
+// releaseReadBuffer returns the native read buffer to the pool once the request
+// has finished. A buffer still owned by a pending read is forgotten by close
+// instead, as Cronet destroys it together with the request. It must be called
+// with r.reading held.
+func (r *urlResponse) releaseReadBuffer() {
+	r.access.Lock()
+	defer r.access.Unlock()
+	r.readData = nil
+	if r.readBuffer.ptr == 0 {
+		return
+	}
+	if !r.readPending {
+		releaseReadBuffer(r.readBuffer)
+	}
+	r.readBuffer = Buffer{}
+}
+
 func (r *urlResponse) Close() error {
 	r.access.Lock()
 	select {
@@ -206,6 +581,7 @@ func (r *urlResponse) Close() error {
 		return os.ErrClosed
 	case <-r.done:
 		r.access.Unlock()
+		r.releaseIdleReadBuffer()
 		return os.ErrClosed
 	default:
 		close(r.cancel)
@@ -217,28 +593,53 @@ func (r *urlResponse) Close() error {
 	// This ensures that the request is fully destroyed before the caller
 	// can destroy the engine or executor.
 	<-r.done
+	r.releaseIdleReadBuffer()
 	return nil
 }
 
+// releaseIfClosed releases the read buffer after Close, which may have been
+// called while a Read was in progress. It must be called with r.reading held.
+func (r *urlResponse) releaseIfClosed() {
+	select {
+	case <-r.cancel:
+		r.releaseReadBuffer()
+	default:
+	}
+}
+
+// releaseIdleReadBuffer releases the read buffer unless a concurrent Read is
+// still using it, in which case that Read releases it when it returns.
+func (r *urlResponse) releaseIdleReadBuffer() {
+	if r.reading.TryLock() {
+		r.releaseReadBuffer()
+		r.reading.Unlock()
+	}
+}
+
 func (r *urlResponse) OnReadCompleted(self URLRequestCallback, request URLRequest, info URLResponseInfo, buffer Buffer, bytesRead int64) {
 	r.access.Lock()
-	defer r.access.Unlock()
+	r.readPending = false
+	r.access.Unlock()
 
 	if bytesRead == 0 {
 		r.close(request, io.EOF)
 		return
 	}
+	if r.progress != nil {
+		r.progress.addReceived(bytesRead, false)
+	}
 
 	select {
 	case <-r.cancel:
 	case <-r.done:
 	case r.read <- int(bytesRead):
-		r.readBuffer.Destroy()
-		r.readBuffer = Buffer{}
 	}
 }
 
 func (r *urlResponse) OnSucceeded(self URLRequestCallback, request URLRequest, info URLResponseInfo) {
+	if r.progress != nil {
+		r.progress.addReceived(0, true)
+	}
 	r.close(request, io.EOF)
 }
 
@@ -263,16 +664,24 @@ func (r *urlResponse) close(request URLRequest, err error) {
 	if r.err == nil {
 		r.err = err
 	}
+	if r.readPending {
+		// Cronet never completes the pending read, and destroys its buffer
+		// with the request.
+		r.readPending = false
+		r.readBuffer = Buffer{}
+	}
 
 	r.wgDone.Do(r.wg.Done)
 	close(r.done)
 	request.Destroy()
+	r.roundTripper.activeRequests.Done()
 }
 
 type bodyUploadProvider struct {
 	body          io.ReadCloser
 	getBody       func() (io.ReadCloser, error)
 	contentLength int64
+	progress      *progressReporter
 }
 
 func (p *bodyUploadProvider) Length(self UploadDataProvider) int64 {
@@ -281,13 +690,22 @@ func (p *bodyUploadProvider) Length(self UploadDataProvider) int64 {
 
 func (p *bodyUploadProvider) Read(self UploadDataProvider, sink UploadDataSink, buffer Buffer) {
 	n, err := p.body.Read(buffer.DataSlice())
+	if n > 0 && err == io.EOF {
+		err = nil
+	}
 	if err != nil {
 		if p.contentLength == -1 && err == io.EOF {
+			if p.progress != nil {
+				p.progress.addSent(0, true)
+			}
 			sink.OnReadSucceeded(0, true)
 			return
 		}
 		sink.OnReadError(err.Error())
 	} else {
+		if p.progress != nil {
+			p.progress.addSent(int64(n), false)
+		}
 		sink.OnReadSucceeded(int64(n), false)
 	}
 }
@@ -304,6 +722,9 @@ func (p *bodyUploadProvider) Rewind(self UploadDataProvider, sink UploadDataSink
 		return
 	}
 	p.body = newBody
+	if p.progress != nil {
+		p.progress.resetSent()
+	}
 	sink.OnRewindSucceeded()
 }
 
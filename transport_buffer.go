@@ -0,0 +1,30 @@
+package cronet
+
+const (
+	readBufferSize     = 64 * 1024
+	readBufferPoolSize = 64
+)
+
+// readBufferPool keeps native read buffers for reuse across responses.
+// A channel is used instead of sync.Pool since native memory must be
+// destroyed explicitly when it is dropped.
+var readBufferPool = make(chan Buffer, readBufferPoolSize)
+
+func acquireReadBuffer() Buffer {
+	select {
+	case buffer := <-readBufferPool:
+		return buffer
+	default:
+	}
+	buffer := NewBuffer()
+	buffer.InitWithAlloc(readBufferSize)
+	return buffer
+}
+
+func releaseReadBuffer(buffer Buffer) {
+	select {
+	case readBufferPool <- buffer:
+	default:
+		buffer.Destroy()
+	}
+}
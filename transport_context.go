@@ -0,0 +1,93 @@
+package cronet
+
+import (
+	"context"
+	"unsafe"
+)
+
+type requestOptionsKey struct{}
+
+// requestOptions holds the per-request URLRequestParams set through the
+// request context. It is copied on every change so parent contexts are not
+// affected.
+type requestOptions struct {
+	priority            URLRequestParamsRequestPriority
+	hasPriority         bool
+	idempotency         URLRequestParamsIdempotency
+	disableCache        bool
+	allowDirectExecutor bool
+	annotations         []unsafe.Pointer
+	progress            ProgressFunc
+	progressGranularity int64
+	status              *RequestStatus
+}
+
+func contextRequestOptions(ctx context.Context) requestOptions {
+	options, _ := ctx.Value(requestOptionsKey{}).(requestOptions)
+	return options
+}
+
+func withRequestOptions(ctx context.Context, update func(options *requestOptions)) context.Context {
+	options := contextRequestOptions(ctx)
+	options.annotations = append([]unsafe.Pointer(nil), options.annotations...)
+	update(&options)
+	return context.WithValue(ctx, requestOptionsKey{}, options)
+}
+
+// WithPriority returns a context that makes RoundTripper send requests with the given priority.
+func WithPriority(ctx context.Context, priority URLRequestParamsRequestPriority) context.Context {
+	return withRequestOptions(ctx, func(options *requestOptions) {
+		options.priority = priority
+		options.hasPriority = true
+	})
+}
+
+// WithIdempotency returns a context that makes RoundTripper mark requests with the given
+// idempotency, which allows Cronet to retry idempotent requests such as safe POSTs.
+func WithIdempotency(ctx context.Context, idempotency URLRequestParamsIdempotency) context.Context {
+	return withRequestOptions(ctx, func(options *requestOptions) {
+		options.idempotency = idempotency
+	})
+}
+
+// WithDisableCache returns a context that makes RoundTripper bypass the HTTP cache.
+func WithDisableCache(ctx context.Context) context.Context {
+	return withRequestOptions(ctx, func(options *requestOptions) {
+		options.disableCache = true
+	})
+}
+
+// WithAllowDirectExecutor returns a context that allows Cronet to run request callbacks
+// directly on its network thread instead of posting them to the Executor.
+// The request body must not block when this is set.
+func WithAllowDirectExecutor(ctx context.Context) context.Context {
+	return withRequestOptions(ctx, func(options *requestOptions) {
+		options.allowDirectExecutor = true
+	})
+}
+
+// WithAnnotation returns a context that attaches annotation to requests, which is
+// reported back by RequestFinishedInfo.AnnotationAt.
+func WithAnnotation(ctx context.Context, annotation unsafe.Pointer) context.Context {
+	return withRequestOptions(ctx, func(options *requestOptions) {
+		options.annotations = append(options.annotations, annotation)
+	})
+}
+
+func (o requestOptions) apply(params URLRequestParams) {
+	if o.hasPriority {
+		params.SetPriority(o.priority)
+	}
+	if o.idempotency != URLRequestParamsIdempotencyDefaultIdempotency {
+		params.SetIdempotency(o.idempotency)
+	}
+	if o.disableCache {
+		params.SetDisableCache(true)
+	}
+	if o.allowDirectExecutor {
+		params.SetAllowDirectExecutor(true)
+	}
+	for _, annotation := range o.annotations {
+		params.AddAnnotation(annotation)
+	}
+}
@@ -0,0 +1,29 @@
+package cronet
+
+import (
+	"context"
+	"testing"
+	"unsafe"
+)
+
+func TestRequestOptionsContext(t *testing.T) {
+	var annotation int
+	parent := WithPriority(context.Background(), URLRequestParamsRequestPriorityIdle)
+	child := WithAnnotation(WithDisableCache(WithIdempotency(parent, URLRequestParamsIdempotencyIdempotent)), unsafe.Pointer(&annotation))
+
+	options := contextRequestOptions(child)
+	if !options.hasPriority || options.priority != URLRequestParamsRequestPriorityIdle {
+		t.Error("priority not inherited from parent context")
+	}
+	if options.idempotency != URLRequestParamsIdempotencyIdempotent || !options.disableCache {
+		t.Error("options not applied to child context")
+	}
+	if len(options.annotations) != 1 || options.annotations[0] != unsafe.Pointer(&annotation) {
+		t.Error("annotation not applied to child context")
+	}
+
+	parentOptions := contextRequestOptions(parent)
+	if parentOptions.disableCache || len(parentOptions.annotations) != 0 {
+		t.Error("child options leaked into parent context")
+	}
+}
@@ -0,0 +1,93 @@
+package cronet
+
+import (
+	"context"
+	"sync"
+)
+
+// Progress is the transfer progress of a RoundTripper request.
+type Progress struct {
+	// BytesSent is the number of request body bytes read by Cronet.
+	BytesSent int64
+	// TotalSend is the request body length, or -1 if unknown.
+	TotalSend int64
+	// BytesReceived is the number of response body bytes received.
+	BytesReceived int64
+	// TotalReceive is the response body length, or -1 if unknown.
+	TotalReceive int64
+}
+
+// ProgressFunc receives progress updates. It is called synchronously from Cronet
+// callbacks and must not block.
+type ProgressFunc func(progress Progress)
+
+// WithProgress returns a context that makes RoundTripper report the upload and download
+// progress of requests to progressFunc. Updates are reported each time at least
+// granularity bytes have moved in one direction, and when a direction completes.
+// A granularity of zero or less reports every chunk.
+func WithProgress(ctx context.Context, granularity int64, progressFunc ProgressFunc) context.Context {
+	return withRequestOptions(ctx, func(options *requestOptions) {
+		options.progress = progressFunc
+		options.progressGranularity = granularity
+	})
+}
+
+type progressReporter struct {
+	access       sync.Mutex
+	progressFunc ProgressFunc
+	granularity  int64
+	progress     Progress
+	lastSent     int64
+	lastReceived int64
+}
+
+func newProgressReporter(options requestOptions, totalSend int64) *progressReporter {
+	if options.progress == nil {
+		return nil
+	}
+	return &progressReporter{
+		progressFunc: options.progress,
+		granularity:  options.progressGranularity,
+		progress: Progress{
+			TotalSend:    totalSend,
+			TotalReceive: -1,
+		},
+	}
+}
+
+func (p *progressReporter) setTotalReceive(totalReceive int64) {
+	p.access.Lock()
+	p.progress.TotalReceive = totalReceive
+	p.access.Unlock()
+}
+
+func (p *progressReporter) resetSent() {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.progress.BytesSent = 0
+	p.lastSent = 0
+	p.progressFunc(p.progress)
+}
+
+func (p *progressReporter) addSent(n int64, final bool) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.progress.BytesSent += n
+	if p.progress.TotalSend > 0 && p.progress.BytesSent >= p.progress.TotalSend {
+		final = true
+	}
+	if final || p.progress.BytesSent-p.lastSent >= p.granularity {
+		p.lastSent = p.progress.BytesSent
+		p.progressFunc(p.progress)
+	}
+}
+
+func (p *progressReporter) addReceived(n int64, final bool) {
+	p.access.Lock()
+	defer p.access.Unlock()
+	p.progress.BytesReceived += n
+	if final || p.progress.BytesReceived-p.lastReceived >= p.granularity {
+		p.lastReceived = p.progress.BytesReceived
+		p.progressFunc(p.progress)
+	}
+}
@@ -0,0 +1,32 @@
+package cronet
+
+import (
+	"context"
+	"testing"
+)
+
+func TestProgressReporterGranularity(t *testing.T) {
+	var reports []Progress
+	ctx := WithProgress(context.Background(), 100, func(progress Progress) {
+		reports = append(reports, progress)
+	})
+	reporter := newProgressReporter(contextRequestOptions(ctx), 250)
+	reporter.setTotalReceive(-1)
+
+	for i := 0; i < 5; i++ {
+		reporter.addSent(50, false)
+	}
+	if len(reports) != 3 {
+		t.Fatalf("expected 3 upload reports, got %d", len(reports))
+	}
+	if last := reports[len(reports)-1]; last.BytesSent != 250 || last.TotalSend != 250 {
+		t.Errorf("unexpected final upload report: %+v", last)
+	}
+
+	reports = nil
+	reporter.addReceived(30, false)
+	reporter.addReceived(0, true)
+	if len(reports) != 1 || reports[0].BytesReceived != 30 || reports[0].TotalReceive != -1 {
+		t.Errorf("unexpected download reports: %+v", reports)
+	}
+}
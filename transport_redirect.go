@@ -0,0 +1,156 @@
+package cronet
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const defaultMaxRedirects = 10
+
+func defaultCheckRedirect(request *http.Request, via []*http.Request) error {
+	if len(via) >= defaultMaxRedirects {
+		return errors.New("stopped after 10 redirects")
+	}
+	return nil
+}
+
+// redirectRequest builds the request for the next hop of a redirect, following
+// the rules of http.Client. It returns a nil request when the redirect response
+// itself should be returned to the caller.
+func (t *RoundTripper) redirectRequest(request *http.Request, response *urlResponse, via []*http.Request) (*http.Request, error) {
+	redirectMethod, includeBody, shouldRedirect := redirectBehavior(request, response.response.StatusCode)
+	if !shouldRedirect {
+		return nil, nil
+	}
+	location, err := request.URL.Parse(response.redirectLocation)
+	if err != nil {
+		return nil, err
+	}
+	nextRequest, err := http.NewRequestWithContext(request.Context(), redirectMethod, location.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	nextRequest.Response = &response.response
+	initialRequest := request
+	if len(via) > 0 {
+		initialRequest = via[0]
+	}
+	copyRedirectHeaders(nextRequest, initialRequest, append(via, request))
+	if referer := redirectReferer(initialRequest, request, nextRequest); referer != "" {
+		nextRequest.Header.Set("Referer", referer)
+	}
+	if includeBody && request.GetBody != nil {
+		nextRequest.Body, err = request.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		nextRequest.GetBody = request.GetBody
+		nextRequest.ContentLength = request.ContentLength
+	}
+
+	checkRedirect := t.RedirectPolicy
+	if checkRedirect == nil {
+		checkRedirect = defaultCheckRedirect
+		if t.CheckRedirect != nil {
+			checkRedirect = func(request *http.Request, via []*http.Request) error {
+				err := defaultCheckRedirect(request, via)
+				if err != nil {
+					return err
+				}
+				if !t.CheckRedirect(response.redirectLocation) {
+					return http.ErrUseLastResponse
+				}
+				return nil
+			}
+		}
+	}
+	err = checkRedirect(nextRequest, append(via, request))
+	if err != nil {
+		if nextRequest.Body != nil {
+			nextRequest.Body.Close()
+		}
+		if errors.Is(err, http.ErrUseLastResponse) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return nextRequest, nil
+}
+
+// redirectBehavior mirrors net/http: 301, 302 and 303 switch to GET without a
+// body, while 307 and 308 repeat the request and require GetBody to rewind it.
+func redirectBehavior(request *http.Request, statusCode int) (redirectMethod string, includeBody bool, shouldRedirect bool) {
+	method := request.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther:
+		redirectMethod = method
+		if method != http.MethodGet && method != http.MethodHead {
+			redirectMethod = http.MethodGet
+		}
+		shouldRedirect = true
+	case http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		redirectMethod = method
+		includeBody = true
+		shouldRedirect = request.GetBody != nil || request.Body == nil || request.Body == http.NoBody
+	}
+	return
+}
+
+// copyRedirectHeaders copies the headers of the initial request to the next
+// hop, like http.Client. Sensitive headers are dropped once any hop leaves
+// the initial host and its subdomains.
+func copyRedirectHeaders(nextRequest *http.Request, initialRequest *http.Request, via []*http.Request) {
+	initialHost := initialRequest.URL.Hostname()
+	copySensitive := shouldCopySensitiveHeaders(initialHost, nextRequest.URL.Hostname())
+	for _, hop := range via[1:] {
+		if !copySensitive {
+			break
+		}
+		copySensitive = shouldCopySensitiveHeaders(initialHost, hop.URL.Hostname())
+	}
+	for key, values := range initialRequest.Header {
+		if !copySensitive && isSensitiveRedirectHeader(key) {
+			continue
+		}
+		nextRequest.Header[key] = append([]string(nil), values...)
+	}
+}
+
+func isSensitiveRedirectHeader(key string) bool {
+	switch http.CanonicalHeaderKey(key) {
+	case "Authorization", "Www-Authenticate", "Cookie", "Cookie2", "Proxy-Authorization":
+		return true
+	default:
+		return false
+	}
+}
+
+// shouldCopySensitiveHeaders reports whether credentials may follow a redirect
+// from initialHost to destinationHost: only to the same host or its subdomains.
+func shouldCopySensitiveHeaders(initialHost string, destinationHost string) bool {
+	initialHost = strings.ToLower(initialHost)
+	destinationHost = strings.ToLower(destinationHost)
+	if initialHost == destinationHost {
+		return true
+	}
+	return strings.HasSuffix(destinationHost, "."+initialHost)
+}
+
+// redirectReferer returns the Referer for the next hop, or "" to send only an
+// explicit Referer copied from the initial request.
+func redirectReferer(initialRequest *http.Request, lastRequest *http.Request, nextRequest *http.Request) string {
+	if lastRequest.URL.Scheme == "https" && nextRequest.URL.Scheme == "http" {
+		return ""
+	}
+	if initialRequest.Header.Get("Referer") != "" {
+		return ""
+	}
+	referer := *lastRequest.URL
+	referer.User = nil
+	referer.Fragment = ""
+	return referer.String()
+}
@@ -0,0 +1,122 @@
+package cronet
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRedirectBehavior(t *testing.T) {
+	testCases := []struct {
+		method         string
+		statusCode     int
+		hasGetBody     bool
+		redirectMethod string
+		includeBody    bool
+		shouldRedirect bool
+	}{
+		{http.MethodPost, http.StatusMovedPermanently, false, http.MethodGet, false, true},
+		{http.MethodPost, http.StatusFound, false, http.MethodGet, false, true},
+		{http.MethodHead, http.StatusSeeOther, false, http.MethodHead, false, true},
+		{http.MethodPut, http.StatusTemporaryRedirect, true, http.MethodPut, true, true},
+		{http.MethodPost, http.StatusPermanentRedirect, false, http.MethodPost, true, false},
+		{http.MethodGet, http.StatusNotModified, false, "", false, false},
+	}
+	for _, testCase := range testCases {
+		request, err := http.NewRequest(testCase.method, "https://example.org/", strings.NewReader("body"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !testCase.hasGetBody {
+			request.GetBody = nil
+		}
+		redirectMethod, includeBody, shouldRedirect := redirectBehavior(request, testCase.statusCode)
+		if redirectMethod != testCase.redirectMethod || includeBody != testCase.includeBody || shouldRedirect != testCase.shouldRedirect {
+			t.Errorf("%s %d: got (%q, %v, %v), want (%q, %v, %v)", testCase.method, testCase.statusCode,
+				redirectMethod, includeBody, shouldRedirect,
+				testCase.redirectMethod, testCase.includeBody, testCase.shouldRedirect)
+		}
+	}
+}
+
+func TestCopyRedirectHeaders(t *testing.T) {
+	request, _ := http.NewRequest(http.MethodGet, "https://example.org/", nil)
+	request.Header.Set("Authorization", "Bearer token")
+	request.Header.Set("Cookie", "a=1")
+	request.Header.Set("Accept", "*/*")
+	via := []*http.Request{request}
+
+	sameOrigin, _ := http.NewRequest(http.MethodGet, "https://api.example.org/", nil)
+	copyRedirectHeaders(sameOrigin, request, via)
+	if sameOrigin.Header.Get("Authorization") == "" || sameOrigin.Header.Get("Cookie") == "" {
+		t.Error("sensitive headers stripped on subdomain redirect")
+	}
+
+	crossOrigin, _ := http.NewRequest(http.MethodGet, "https://example.com/", nil)
+	copyRedirectHeaders(crossOrigin, request, via)
+	if crossOrigin.Header.Get("Authorization") != "" || crossOrigin.Header.Get("Cookie") != "" {
+		t.Error("sensitive headers kept on cross-origin redirect")
+	}
+	if crossOrigin.Header.Get("Accept") != "*/*" {
+		t.Error("regular header dropped on redirect")
+	}
+
+	// Hosts are compared with the initial request, and once a hop left it,
+	// sensitive headers stay dropped even when redirected back.
+	back, _ := http.NewRequest(http.MethodGet, "https://example.org/back", nil)
+	copyRedirectHeaders(back, request, append(via, crossOrigin))
+	if back.Header.Get("Authorization") != "" || back.Header.Get("Cookie") != "" {
+		t.Error("sensitive headers restored after a cross-origin hop")
+	}
+	if back.Header.Get("Accept") != "*/*" {
+		t.Error("regular header dropped after a cross-origin hop")
+	}
+
+	subdomainRequest, _ := http.NewRequest(http.MethodGet, "https://api.example.org/", nil)
+	subdomainRequest.Header.Set("Authorization", "Bearer token")
+	parent, _ := http.NewRequest(http.MethodGet, "https://example.org/", nil)
+	copyRedirectHeaders(parent, subdomainRequest, []*http.Request{subdomainRequest})
+	if parent.Header.Get("Authorization") != "" {
+		t.Error("sensitive headers kept on redirect to a parent domain")
+	}
+}
+
+func TestRedirectRequestCheckRedirect(t *testing.T) {
+	var locations []string
+	transport := &RoundTripper{
+		CheckRedirect: func(newLocationUrl string) bool {
+			locations = append(locations, newLocationUrl)
+			return newLocationUrl == "https://example.org/follow"
+		},
+	}
+	redirect := func(location string) *urlResponse {
+		return &urlResponse{
+			response:         http.Response{StatusCode: http.StatusFound},
+			redirectLocation: location,
+		}
+	}
+	request, _ := http.NewRequest(http.MethodGet, "https://example.org/", nil)
+
+	nextRequest, err := transport.redirectRequest(request, redirect("https://example.org/follow"), nil)
+	if err != nil || nextRequest == nil || nextRequest.URL.Path != "/follow" {
+		t.Fatalf("redirect allowed by CheckRedirect was not followed: %v, %v", nextRequest, err)
+	}
+	nextRequest, err = transport.redirectRequest(request, redirect("https://example.org/stop"), nil)
+	if err != nil || nextRequest != nil {
+		t.Fatalf("redirect rejected by CheckRedirect was followed: %v, %v", nextRequest, err)
+	}
+	if len(locations) != 2 {
+		t.Errorf("unexpected CheckRedirect calls: %v", locations)
+	}
+
+	transport.RedirectPolicy = func(request *http.Request, via []*http.Request) error {
+		return nil
+	}
+	nextRequest, err = transport.redirectRequest(request, redirect("https://example.org/stop"), nil)
+	if err != nil || nextRequest == nil {
+		t.Fatalf("RedirectPolicy did not take precedence over CheckRedirect: %v, %v", nextRequest, err)
+	}
+	if len(locations) != 2 {
+		t.Error("CheckRedirect called although RedirectPolicy is set")
+	}
+}
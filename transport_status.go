@@ -0,0 +1,73 @@
+package cronet
+
+import (
+	"context"
+	"sync"
+)
+
+// RequestStatus queries the live status of an in-flight RoundTripper request,
+// for example to tell a request stuck in the socket pool from one waiting for
+// the server. Create one with WithRequestStatus.
+type RequestStatus struct {
+	access   sync.Mutex
+	response *urlResponse
+}
+
+// WithRequestStatus returns a context that binds the returned RequestStatus to the
+// request sent with it. When redirects are followed, the status tracks the current hop.
+func WithRequestStatus(ctx context.Context) (context.Context, *RequestStatus) {
+	status := &RequestStatus{}
+	return withRequestOptions(ctx, func(options *requestOptions) {
+		options.status = status
+	}), status
+}
+
+func (s *RequestStatus) setResponse(response *urlResponse) {
+	s.access.Lock()
+	s.response = response
+	s.access.Unlock()
+}
+
+// Status returns the current status of the request, waiting for Cronet to report it.
+// It returns URLRequestStatusListenerStatusInvalid if the request has not started,
+// or has finished or been canceled before Cronet reported a status.
+func (s *RequestStatus) Status() URLRequestStatusListenerStatus {
+	s.access.Lock()
+	response := s.response
+	s.access.Unlock()
+	if response == nil {
+		return URLRequestStatusListenerStatusInvalid
+	}
+	return response.status()
+}
+
+func (r *urlResponse) status() URLRequestStatusListenerStatus {
+	r.access.Lock()
+	select {
+	case <-r.done:
+		r.access.Unlock()
+		return URLRequestStatusListenerStatusInvalid
+	case <-r.cancel:
+		r.access.Unlock()
+		return URLRequestStatusListenerStatusInvalid
+	default:
+	}
+	// The listener destroys itself once called, as the request may finish
+	// before Cronet reports back.
+	result := make(chan URLRequestStatusListenerStatus, 1)
+	listener := NewURLRequestStatusListener(func(self URLRequestStatusListener, status URLRequestStatusListenerStatus) {
+		result <- status
+		self.Destroy()
+	})
+	r.request.GetStatus(listener)
+	r.access.Unlock()
+
+	select {
+	case status := <-result:
+		return status
+	case <-r.done:
+		return URLRequestStatusListenerStatusInvalid
+	case <-r.cancel:
+		return URLRequestStatusListenerStatusInvalid
+	}
+}
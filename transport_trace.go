@@ -0,0 +1,150 @@
+package cronet
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// requestTrace bridges Cronet request events to a httptrace.ClientTrace.
+//
+// Cronet does not report connection events while a request is running, so
+// GetConn and GotFirstResponseByte fire live, and the DNS, connect, TLS,
+// GotConn and WroteRequest hooks are replayed from Metrics once the request
+// has finished. GotConnInfo.Conn is always nil.
+type requestTrace struct {
+	trace             *httptrace.ClientTrace
+	host              string
+	hostPort          string
+	firstResponseOnce sync.Once
+}
+
+func newRequestTrace(trace *httptrace.ClientTrace, requestURL *url.URL) *requestTrace {
+	if trace == nil {
+		return nil
+	}
+	return &requestTrace{trace: trace, host: requestURL.Hostname(), hostPort: canonicalHostPort(requestURL)}
+}
+
+func canonicalHostPort(requestURL *url.URL) string {
+	port := requestURL.Port()
+	if port == "" {
+		if requestURL.Scheme == "http" {
+			port = "80"
+		} else {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(requestURL.Hostname(), port)
+}
+
+func (t *requestTrace) getConn() {
+	if t.trace.GetConn != nil {
+		t.trace.GetConn(t.hostPort)
+	}
+}
+
+func (t *requestTrace) gotFirstResponseByte() {
+	if t.trace.GotFirstResponseByte != nil {
+		t.firstResponseOnce.Do(t.trace.GotFirstResponseByte)
+	}
+}
+
+// listener returns a one-shot URLRequestFinishedInfoListener that replays
+// the trace from the request metrics and destroys itself.
+func (t *requestTrace) listener() URLRequestFinishedInfoListener {
+	return NewURLRequestFinishedInfoListener(func(listener URLRequestFinishedInfoListener, requestInfo RequestFinishedInfo, responseInfo URLResponseInfo, requestError Error) {
+		var err error
+		if requestError.ptr != 0 {
+			err = ErrorFromError(requestError)
+		}
+		var negotiatedProtocol string
+		if responseInfo.ptr != 0 {
+			negotiatedProtocol = responseInfo.NegotiatedProtocol()
+		}
+		t.replay(requestInfo.Metrics(), negotiatedProtocol, err)
+		listener.Destroy()
+	})
+}
+
+func (t *requestTrace) replay(metrics Metrics, negotiatedProtocol string, err error) {
+	if metrics.ptr == 0 {
+		return
+	}
+	trace := t.trace
+	reused := metrics.SocketReused()
+	if !reused {
+		if _, loaded := metricsTime(metrics.DNSStart()); loaded {
+			if trace.DNSStart != nil {
+				trace.DNSStart(httptrace.DNSStartInfo{Host: t.host})
+			}
+			if trace.DNSDone != nil {
+				var dnsErr error
+				if _, loaded = metricsTime(metrics.DNSEnd()); !loaded {
+					dnsErr = err
+				}
+				trace.DNSDone(httptrace.DNSDoneInfo{Err: dnsErr})
+			}
+		}
+		if _, loaded := metricsTime(metrics.ConnectStart()); loaded {
+			network := "tcp"
+			if _, major, _ := httpProtoFromNegotiated(negotiatedProtocol); major == 3 {
+				network = "udp"
+			}
+			if trace.ConnectStart != nil {
+				trace.ConnectStart(network, t.hostPort)
+			}
+			if trace.ConnectDone != nil {
+				var connectErr error
+				if _, loaded = metricsTime(metrics.ConnectEnd()); !loaded {
+					connectErr = err
+				}
+				trace.ConnectDone(network, t.hostPort, connectErr)
+			}
+		}
+		if _, loaded := metricsTime(metrics.SSLStart()); loaded {
+			if trace.TLSHandshakeStart != nil {
+				trace.TLSHandshakeStart()
+			}
+			if trace.TLSHandshakeDone != nil {
+				var handshakeErr error
+				_, handshakeDone := metricsTime(metrics.SSLEnd())
+				if !handshakeDone {
+					handshakeErr = err
+				}
+				trace.TLSHandshakeDone(tls.ConnectionState{
+					HandshakeComplete:  handshakeDone,
+					NegotiatedProtocol: negotiatedProtocol,
+					ServerName:         t.host,
+				}, handshakeErr)
+			}
+		}
+	}
+	if _, loaded := metricsTime(metrics.SendingStart()); !loaded {
+		return
+	}
+	if trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Reused: reused})
+	}
+	if trace.WroteHeaders != nil {
+		trace.WroteHeaders()
+	}
+	if trace.WroteRequest != nil {
+		var writeErr error
+		if _, loaded := metricsTime(metrics.SendingEnd()); !loaded {
+			writeErr = err
+		}
+		trace.WroteRequest(httptrace.WroteRequestInfo{Err: writeErr})
+	}
+}
+
+// metricsTime returns the value of an optional Metrics timestamp.
+func metricsTime(dateTime DateTime) (time.Time, bool) {
+	if dateTime.ptr == 0 {
+		return time.Time{}, false
+	}
+	return dateTime.Value(), true
+}
@@ -10,7 +10,6 @@ import (
 
 func (l URLRequestFinishedInfoListener) Destroy() {
 	l.destroy()
-	cronet.RequestFinishedInfoListenerDestroy(l.ptr)
 }
 
 func (l URLRequestFinishedInfoListener) SetClientContext(context unsafe.Pointer) {
@@ -0,0 +1,306 @@
+package cronet
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	E "github.com/sagernet/sing/common/exceptions"
+	"github.com/sagernet/sing/common/logger"
+	M "github.com/sagernet/sing/common/metadata"
+	N "github.com/sagernet/sing/common/network"
+)
+
+const webSocketAcceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+var errExtendedConnectNotSupported = E.New("websocket: extended CONNECT not supported by server")
+
+// WebSocketDialer dials WebSocket connections.
+//
+// wss:// URLs are first dialed with HTTP/2 or HTTP/3 extended CONNECT
+// (RFC 8441, RFC 9220) on a Cronet bidirectional stream, which shares the
+// engine's connection pool, proxy, DNS, QUIC support and TLS fingerprint.
+// The server must enable extended CONNECT.
+//
+// With EnableHTTP1Fallback, ws:// URLs and servers that do not support
+// extended CONNECT use an HTTP/1.1 Upgrade over Dialer and TLSConfig
+// instead, which bypasses the engine and uses Go's TLS stack.
+type WebSocketDialer struct {
+	// Engine must be started and outlive all connections.
+	Engine       Engine
+	Logger       logger.ContextLogger
+	Header       http.Header
+	Subprotocols []string
+	// EnableHTTP1Fallback allows ws:// URLs, and falls back to an HTTP/1.1
+	// Upgrade when the server does not support extended CONNECT: it requires
+	// HTTP/1.1, rejects the request with a protocol error or answers 501.
+	// Other failures, such as TLS errors or authentication failures, are
+	// returned as is.
+	EnableHTTP1Fallback bool
+	// Dialer is used by the HTTP/1.1 fallback. Defaults to N.SystemDialer.
+	Dialer N.Dialer
+	// TLSConfig is used by the HTTP/1.1 fallback for wss:// URLs.
+	TLSConfig *tls.Config
+	// MaxMessageSize limits the size of received messages. Defaults to 16 MiB.
+	MaxMessageSize int64
+}
+
+// DialContext opens a WebSocket connection to rawURL. ctx only bounds the
+// handshake.
+func (d *WebSocketDialer) DialContext(ctx context.Context, rawURL string) (*WebSocketConn, error) {
+	requestURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	switch requestURL.Scheme {
+	case "wss", "https":
+		requestURL.Scheme = "https"
+	case "ws", "http":
+		requestURL.Scheme = "http"
+	default:
+		return nil, E.New("websocket: unsupported scheme: ", requestURL.Scheme)
+	}
+	l := d.Logger
+	if l == nil {
+		l = logger.NOP()
+	}
+	if requestURL.Scheme == "https" {
+		var emptyEngine Engine
+		if d.Engine == emptyEngine {
+			return nil, E.New("missing engine")
+		}
+		conn, connectErr := d.dialExtendedConnect(ctx, l, requestURL)
+		if connectErr == nil || !d.EnableHTTP1Fallback || ctx.Err() != nil || !isExtendedConnectNotSupported(connectErr) {
+			return conn, connectErr
+		}
+		l.DebugContext(ctx, "websocket extended CONNECT to ", requestURL.Host, " failed, fallback to HTTP/1.1: ", connectErr)
+		conn, err = d.dialHTTP1(ctx, requestURL)
+		if err != nil {
+			return nil, E.Errors(connectErr, err)
+		}
+		return conn, nil
+	}
+	if !d.EnableHTTP1Fallback {
+		return nil, E.New("websocket: extended CONNECT requires a secure URL")
+	}
+	return d.dialHTTP1(ctx, requestURL)
+}
+
+// isExtendedConnectNotSupported reports whether err shows that the server
+// can not handle extended CONNECT at all, rather than rejecting this request.
+func isExtendedConnectNotSupported(err error) bool {
+	return errors.Is(err, errExtendedConnectNotSupported) ||
+		errors.Is(err, NetErrorHTTP11Required) ||
+		errors.Is(err, NetErrorHTTP2ProtocolError) ||
+		errors.Is(err, NetErrorQUICProtocolError) ||
+		errors.Is(err, NetErrorNotImplemented)
+}
+
+func (d *WebSocketDialer) dialExtendedConnect(ctx context.Context, l logger.ContextLogger, requestURL *url.URL) (*WebSocketConn, error) {
+	headers := d.requestHeaders()
+	headers[":protocol"] = "websocket"
+	conn := d.Engine.StreamEngine().CreateConn(ctx, l, true, false)
+	err := conn.Start(http.MethodConnect, requestURL.String(), headers, 0, false)
+	if err != nil {
+		return nil, err
+	}
+	var handshakeDone chan struct{}
+	if ctx.Done() != nil {
+		handshakeDone = make(chan struct{})
+		go func() {
+			select {
+			case <-ctx.Done():
+				conn.Close()
+			case <-handshakeDone:
+			}
+		}()
+	}
+	responseHeaders, err := conn.WaitForHeadersContext(ctx)
+	if handshakeDone != nil {
+		close(handshakeDone)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	statusCode, _ := strconv.Atoi(responseHeaders[":status"])
+	proto, protoMajor, protoMinor := httpProtoFromNegotiated(conn.NegotiatedProtocol())
+	response := &http.Response{
+		Status:     strconv.Itoa(statusCode) + " " + http.StatusText(statusCode),
+		StatusCode: statusCode,
+		Proto:      proto,
+		ProtoMajor: protoMajor,
+		ProtoMinor: protoMinor,
+		Header:     make(http.Header, len(responseHeaders)),
+		Body:       http.NoBody,
+	}
+	for key, value := range responseHeaders {
+		if strings.HasPrefix(key, ":") {
+			continue
+		}
+		response.Header.Add(key, value)
+	}
+	if statusCode == http.StatusNotImplemented {
+		conn.Close()
+		return nil, E.Cause(errExtendedConnectNotSupported, response.Status)
+	}
+	if statusCode < 200 || statusCode > 299 {
+		conn.Close()
+		return nil, E.New("websocket: extended CONNECT failed: ", response.Status)
+	}
+	err = d.checkSubprotocol(response)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newWebSocketConn(conn, nil, response, d.MaxMessageSize), nil
+}
+
+func (d *WebSocketDialer) dialHTTP1(ctx context.Context, requestURL *url.URL) (*WebSocketConn, error) {
+	dialer := d.Dialer
+	if dialer == nil {
+		dialer = N.SystemDialer
+	}
+	port := requestURL.Port()
+	if port == "" {
+		if requestURL.Scheme == "https" {
+			port = "443"
+		} else {
+			port = "80"
+		}
+	}
+	conn, err := dialer.DialContext(ctx, N.NetworkTCP, M.ParseSocksaddrHostPortStr(requestURL.Hostname(), port))
+	if err != nil {
+		return nil, err
+	}
+	if deadline, loaded := ctx.Deadline(); loaded {
+		conn.SetDeadline(deadline)
+	}
+	if requestURL.Scheme == "https" {
+		var tlsConfig *tls.Config
+		if d.TLSConfig != nil {
+			tlsConfig = d.TLSConfig.Clone()
+		} else {
+			tlsConfig = &tls.Config{}
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = requestURL.Hostname()
+		}
+		tlsConfig.NextProtos = []string{"http/1.1"}
+		tlsConn := tls.Client(conn, tlsConfig)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	var keyBytes [16]byte
+	_, err = rand.Read(keyBytes[:])
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(keyBytes[:])
+	request := &http.Request{
+		Method:     http.MethodGet,
+		URL:        requestURL,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       requestURL.Host,
+	}
+	for name, value := range d.requestHeaders() {
+		request.Header.Set(name, value)
+	}
+	request.Header.Set("Upgrade", "websocket")
+	request.Header.Set("Connection", "Upgrade")
+	request.Header.Set("Sec-WebSocket-Key", key)
+	err = request.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	response.Body = http.NoBody
+	if response.StatusCode != http.StatusSwitchingProtocols ||
+		!strings.EqualFold(response.Header.Get("Upgrade"), "websocket") ||
+		!headerContainsToken(response.Header, "Connection", "upgrade") {
+		conn.Close()
+		return nil, E.New("websocket: HTTP/1.1 upgrade failed: ", response.Status)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != webSocketAcceptKey(key) {
+		conn.Close()
+		return nil, E.New("websocket: invalid Sec-WebSocket-Accept")
+	}
+	err = d.checkSubprotocol(response)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return newWebSocketConn(conn, reader, response, d.MaxMessageSize), nil
+}
+
+// requestHeaders returns the handshake headers shared by both handshakes,
+// with multi-value headers joined as Cronet only accepts one value per name.
+func (d *WebSocketDialer) requestHeaders() map[string]string {
+	headers := make(map[string]string, len(d.Header)+2)
+	for key, values := range d.Header {
+		if len(values) == 0 {
+			continue
+		}
+		headers[key] = strings.Join(values, ", ")
+	}
+	headers["Sec-WebSocket-Version"] = "13"
+	if len(d.Subprotocols) > 0 {
+		headers["Sec-WebSocket-Protocol"] = strings.Join(d.Subprotocols, ", ")
+	}
+	return headers
+}
+
+func (d *WebSocketDialer) checkSubprotocol(response *http.Response) error {
+	subprotocol := response.Header.Get("Sec-WebSocket-Protocol")
+	if subprotocol == "" {
+		return nil
+	}
+	for _, offered := range d.Subprotocols {
+		if offered == subprotocol {
+			return nil
+		}
+	}
+	return E.New("websocket: server selected unknown subprotocol: ", subprotocol)
+}
+
+func webSocketAcceptKey(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketAcceptGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+func headerContainsToken(header http.Header, name string, token string) bool {
+	for _, value := range header.Values(name) {
+		for _, element := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(element), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
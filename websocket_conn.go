@@ -0,0 +1,313 @@
+package cronet
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+// WebSocketMessageType is the type of a WebSocket data message.
+type WebSocketMessageType int
+
+const (
+	WebSocketTextMessage   WebSocketMessageType = 1
+	WebSocketBinaryMessage WebSocketMessageType = 2
+)
+
+const (
+	webSocketOpContinuation = 0x0
+	webSocketOpText         = 0x1
+	webSocketOpBinary       = 0x2
+	webSocketOpClose        = 0x8
+	webSocketOpPing         = 0x9
+	webSocketOpPong         = 0xa
+
+	webSocketFinalBit = 0x80
+	webSocketMaskBit  = 0x80
+
+	webSocketMaxControlPayload     = 125
+	webSocketDefaultMaxMessageSize = 16 * 1024 * 1024
+
+	WebSocketCloseNormalClosure   = 1000
+	WebSocketCloseProtocolError   = 1002
+	WebSocketCloseNoStatus        = 1005
+	WebSocketCloseInvalidPayload  = 1007
+	WebSocketCloseMessageTooLarge = 1009
+)
+
+// WebSocketCloseError is returned by WebSocketConn.ReadMessage when the peer
+// sends a close frame.
+type WebSocketCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *WebSocketCloseError) Error() string {
+	if e.Reason == "" {
+		return "websocket closed: " + strconv.Itoa(e.Code)
+	}
+	return "websocket closed: " + strconv.Itoa(e.Code) + " " + e.Reason
+}
+
+// WebSocketConn is a client WebSocket connection created by WebSocketDialer.
+//
+// ReadMessage answers pings and close frames automatically. One goroutine may
+// read while others write; writes are serialized.
+type WebSocketConn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	response       *http.Response
+	subprotocol    string
+	maxMessageSize int64
+
+	readAccess  sync.Mutex
+	writeAccess sync.Mutex
+	closeSent   bool
+	closeOnce   sync.Once
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, response *http.Response, maxMessageSize int64) *WebSocketConn {
+	if reader == nil {
+		reader = bufio.NewReader(conn)
+	}
+	if maxMessageSize <= 0 {
+		maxMessageSize = webSocketDefaultMaxMessageSize
+	}
+	return &WebSocketConn{
+		conn:           conn,
+		reader:         reader,
+		response:       response,
+		subprotocol:    response.Header.Get("Sec-WebSocket-Protocol"),
+		maxMessageSize: maxMessageSize,
+	}
+}
+
+// Subprotocol returns the subprotocol selected by the server, if any.
+func (c *WebSocketConn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Response returns the handshake response. Its body is always empty.
+func (c *WebSocketConn) Response() *http.Response {
+	return c.response
+}
+
+// NetConn returns the underlying stream, which is a *BidirectionalConn for
+// extended CONNECT connections.
+func (c *WebSocketConn) NetConn() net.Conn {
+	return c.conn
+}
+
+func (c *WebSocketConn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+func (c *WebSocketConn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *WebSocketConn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+func (c *WebSocketConn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// ReadMessage reads the next data message, reassembling fragments.
+func (c *WebSocketConn) ReadMessage() (WebSocketMessageType, []byte, error) {
+	c.readAccess.Lock()
+	defer c.readAccess.Unlock()
+	var (
+		messageType WebSocketMessageType
+		message     []byte
+	)
+	for {
+		final, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch opcode {
+		case webSocketOpPing:
+			err = c.writeFrame(webSocketOpPong, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		case webSocketOpPong:
+			continue
+		case webSocketOpClose:
+			return 0, nil, c.handleClose(payload)
+		case webSocketOpText, webSocketOpBinary:
+			if messageType != 0 {
+				return 0, nil, c.fail(WebSocketCloseProtocolError, E.New("websocket: unexpected new message in fragmented message"))
+			}
+			messageType = WebSocketMessageType(opcode)
+		case webSocketOpContinuation:
+			if messageType == 0 {
+				return 0, nil, c.fail(WebSocketCloseProtocolError, E.New("websocket: unexpected continuation frame"))
+			}
+		default:
+			return 0, nil, c.fail(WebSocketCloseProtocolError, E.New("websocket: unknown opcode ", opcode))
+		}
+		if int64(len(message))+int64(len(payload)) > c.maxMessageSize {
+			return 0, nil, c.fail(WebSocketCloseMessageTooLarge, E.New("websocket: message too large"))
+		}
+		message = append(message, payload...)
+		if !final {
+			continue
+		}
+		if messageType == WebSocketTextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(WebSocketCloseInvalidPayload, E.New("websocket: invalid UTF-8 in text message"))
+		}
+		return messageType, message, nil
+	}
+}
+
+func (c *WebSocketConn) readFrame() (final bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	_, err = io.ReadFull(c.reader, header[:])
+	if err != nil {
+		return
+	}
+	final = header[0]&webSocketFinalBit != 0
+	opcode = header[0] & 0x0f
+	if header[0]&0x70 != 0 {
+		err = c.fail(WebSocketCloseProtocolError, E.New("websocket: unexpected reserved bits"))
+		return
+	}
+	if header[1]&webSocketMaskBit != 0 {
+		err = c.fail(WebSocketCloseProtocolError, E.New("websocket: masked frame from server"))
+		return
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var extended [2]byte
+		_, err = io.ReadFull(c.reader, extended[:])
+		if err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(extended[:]))
+	case 127:
+		var extended [8]byte
+		_, err = io.ReadFull(c.reader, extended[:])
+		if err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(extended[:])
+	}
+	if opcode >= webSocketOpClose && (!final || length > webSocketMaxControlPayload) {
+		err = c.fail(WebSocketCloseProtocolError, E.New("websocket: invalid control frame"))
+		return
+	}
+	if length > uint64(c.maxMessageSize) {
+		err = c.fail(WebSocketCloseMessageTooLarge, E.New("websocket: frame too large"))
+		return
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(c.reader, payload)
+	return
+}
+
+func (c *WebSocketConn) handleClose(payload []byte) error {
+	closeErr := &WebSocketCloseError{Code: WebSocketCloseNoStatus}
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+	}
+	if closeErr.Code == WebSocketCloseNoStatus {
+		c.WriteClose(WebSocketCloseNormalClosure, "")
+	} else {
+		c.WriteClose(closeErr.Code, "")
+	}
+	c.closeConn()
+	return closeErr
+}
+
+// fail sends a close frame for a protocol violation and closes the connection.
+func (c *WebSocketConn) fail(code int, err error) error {
+	c.WriteClose(code, "")
+	c.closeConn()
+	return err
+}
+
+// WriteMessage writes data as a single unfragmented message.
+func (c *WebSocketConn) WriteMessage(messageType WebSocketMessageType, data []byte) error {
+	switch messageType {
+	case WebSocketTextMessage, WebSocketBinaryMessage:
+	default:
+		return E.New("websocket: invalid message type ", int(messageType))
+	}
+	return c.writeFrame(byte(messageType), data)
+}
+
+// WriteClose sends a close frame. Later writes fail with net.ErrClosed.
+func (c *WebSocketConn) WriteClose(code int, reason string) error {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	payload = append(payload, reason...)
+	if len(payload) > webSocketMaxControlPayload {
+		return E.New("websocket: close reason too long")
+	}
+	return c.writeFrame(webSocketOpClose, payload)
+}
+
+func (c *WebSocketConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeAccess.Lock()
+	defer c.writeAccess.Unlock()
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == webSocketOpClose {
+		c.closeSent = true
+	}
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, webSocketFinalBit|opcode)
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, webSocketMaskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		frame = append(frame, webSocketMaskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, webSocketMaskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	var maskKey [4]byte
+	_, err := rand.Read(maskKey[:])
+	if err != nil {
+		return err
+	}
+	frame = append(frame, maskKey[:]...)
+	offset := len(frame)
+	frame = append(frame, payload...)
+	for i := range payload {
+		frame[offset+i] ^= maskKey[i&3]
+	}
+	_, err = c.conn.Write(frame)
+	return err
+}
+
+// Close sends a normal closure frame if none was sent and closes the connection.
+func (c *WebSocketConn) Close() error {
+	c.WriteClose(WebSocketCloseNormalClosure, "")
+	return c.closeConn()
+}
+
+func (c *WebSocketConn) closeConn() error {
+	err := net.ErrClosed
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,125 @@
+package cronet
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	E "github.com/sagernet/sing/common/exceptions"
+)
+
+func TestWebSocketAcceptKey(t *testing.T) {
+	t.Parallel()
+	// Example from RFC 6455 section 1.3.
+	if key := webSocketAcceptKey("dGhlIHNhbXBsZSBub25jZQ=="); key != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("unexpected accept key %q", key)
+	}
+}
+
+func TestWebSocketExtendedConnectNotSupported(t *testing.T) {
+	t.Parallel()
+	for _, testCase := range []struct {
+		err         error
+		unsupported bool
+	}{
+		{E.Cause(errExtendedConnectNotSupported, "501 Not Implemented"), true},
+		{NetErrorHTTP11Required, true},
+		{NetErrorHTTP2ProtocolError, true},
+		{NetErrorQUICProtocolError, true},
+		{E.New("websocket: extended CONNECT failed: 401 Unauthorized"), false},
+		{NetErrorCertAuthorityInvalid, false},
+		{NetErrorConnectionRefused, false},
+	} {
+		if unsupported := isExtendedConnectNotSupported(testCase.err); unsupported != testCase.unsupported {
+			t.Errorf("isExtendedConnectNotSupported(%v) = %v", testCase.err, unsupported)
+		}
+	}
+}
+
+func TestWebSocketConnFraming(t *testing.T) {
+	t.Parallel()
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	conn := newWebSocketConn(clientConn, nil, &http.Response{Header: make(http.Header)}, 0)
+	defer conn.Close()
+
+	go func() {
+		conn.WriteMessage(WebSocketBinaryMessage, []byte("hello"))
+	}()
+	opcode, payload := readClientFrame(t, serverConn)
+	if opcode != webSocketOpBinary || string(payload) != "hello" {
+		t.Fatalf("unexpected client frame %d %q", opcode, payload)
+	}
+
+	go func() {
+		serverConn.Write([]byte{webSocketOpText, 3, 'f', 'o', 'o'})
+		serverConn.Write([]byte{webSocketFinalBit | webSocketOpPing, 1, 'p'})
+		serverConn.Write([]byte{webSocketFinalBit | webSocketOpContinuation, 3, 'b', 'a', 'r'})
+	}()
+	messageChan := make(chan string, 1)
+	go func() {
+		messageType, message, err := conn.ReadMessage()
+		if err != nil || messageType != WebSocketTextMessage {
+			close(messageChan)
+			return
+		}
+		messageChan <- string(message)
+	}()
+	opcode, payload = readClientFrame(t, serverConn)
+	if opcode != webSocketOpPong || string(payload) != "p" {
+		t.Fatalf("unexpected pong %d %q", opcode, payload)
+	}
+	if message := <-messageChan; message != "foobar" {
+		t.Fatalf("unexpected message %q", message)
+	}
+
+	go func() {
+		closePayload := binary.BigEndian.AppendUint16(nil, WebSocketCloseNormalClosure)
+		serverConn.Write(append([]byte{webSocketFinalBit | webSocketOpClose, byte(len(closePayload))}, closePayload...))
+	}()
+	errChan := make(chan error, 1)
+	go func() {
+		_, _, err := conn.ReadMessage()
+		errChan <- err
+	}()
+	opcode, payload = readClientFrame(t, serverConn)
+	if opcode != webSocketOpClose || binary.BigEndian.Uint16(payload) != WebSocketCloseNormalClosure {
+		t.Fatalf("unexpected close frame %d %v", opcode, payload)
+	}
+	closeErr, isCloseErr := (<-errChan).(*WebSocketCloseError)
+	if !isCloseErr || closeErr.Code != WebSocketCloseNormalClosure {
+		t.Fatalf("unexpected close error %v", closeErr)
+	}
+	if err := conn.WriteMessage(WebSocketTextMessage, nil); err != net.ErrClosed {
+		t.Fatalf("expected net.ErrClosed after close, got %v", err)
+	}
+}
+
+func readClientFrame(t *testing.T, conn net.Conn) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	_, err := io.ReadFull(conn, header[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header[0]&webSocketFinalBit == 0 || header[1]&webSocketMaskBit == 0 {
+		t.Fatalf("client frame must be final and masked: %x", header)
+	}
+	length := int(header[1] & 0x7f)
+	var maskKey [4]byte
+	_, err = io.ReadFull(conn, maskKey[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := make([]byte, length)
+	_, err = io.ReadFull(conn, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range payload {
+		payload[i] ^= maskKey[i&3]
+	}
+	return header[0] & 0x0f, payload
+}